@@ -0,0 +1,997 @@
+package main
+
+/*
+This file contains the backup and restore functions which are
+available by commandline (-backup and -restore).
+
+A backup file starts with one plain JSON line (the file header). It
+tells about the format version and, if encrypted, the salt used for
+the operator key. The rest of the file is a gzip compressed stream of
+JSON lines. If an operator key is used, this stream is encrypted using
+AES-256-GCM (see cryptWriter).
+
+The first line of the stream describes the tables and columns. Then
+every table row follows as one line. The last line contains the number
+of rows per table. This allows to detect incomplete backup files.
+*/
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	BACKUP_FORMAT  = "dv-vault-backup"
+	BACKUP_VERSION = 1
+)
+
+// Column types used in backup files
+const (
+	COL_STRING = iota
+	COL_INT
+	COL_BYTES
+	COL_TIME
+	COL_STRINGS // string array
+	COL_INTS    // integer array
+)
+
+type backupColumn struct {
+	Name string
+	Type int
+}
+
+type backupTable struct {
+	Name    string
+	Columns []backupColumn
+	HasKey  bool // tables with primary key are restored using UPSERT
+}
+
+// backupTables defines all tables and columns saved by backups.
+// Keep this in sync with installer/database.sql! The tables nodes and
+// idempotency only hold temporary data and are not saved.
+var backupTables = []backupTable{
+	{"provider", []backupColumn{
+		{"PROVIDERID", COL_INT},
+		{"NAME", COL_STRING},
+		{"DESCRIPTION", COL_STRING},
+		{"PASSWORD", COL_STRING},
+		{"IP", COL_STRING},
+		{"CREATIONDATE", COL_TIME},
+		{"HISTORY", COL_INT},
+		{"DELETEGRACEDAYS", COL_INT},
+		{"WEBHOOK", COL_STRING},
+		{"MAXSTALENESS", COL_INT},
+		{"REGION", COL_STRING},
+	}, true},
+	{"data", []backupColumn{
+		{"VID", COL_BYTES},
+		{"PAYLOAD", COL_BYTES},
+		{"PROVIDERID", COL_INT},
+		{"CREATIONDATE", COL_TIME},
+		{"UPDATEDATE", COL_TIME},
+		{"DURATION", COL_INT},
+		{"REVISION", COL_INT},
+		{"EXPIRES", COL_TIME},
+		{"DELETED", COL_TIME},
+		{"REVOKED", COL_TIME},
+		{"MAXREADS", COL_INT},
+		{"READS", COL_INT},
+		{"READERS", COL_INTS},
+	}, true},
+	{"search", []backupColumn{
+		{"VID", COL_BYTES},
+		{"WORD", COL_STRING},
+		{"FIELD", COL_STRING},
+	}, false},
+	{"history", []backupColumn{
+		{"VID", COL_BYTES},
+		{"REVISION", COL_INT},
+		{"PAYLOAD", COL_BYTES},
+		{"WORDS", COL_STRINGS},
+		{"ARCHIVEDATE", COL_TIME},
+	}, true},
+	{"holds", []backupColumn{
+		{"VID", COL_BYTES},
+		{"PROVIDERID", COL_INT},
+		{"REASON", COL_STRING},
+		{"UNTIL", COL_TIME},
+		{"CREATIONDATE", COL_TIME},
+	}, true},
+	{"publishaccess", []backupColumn{
+		{"ID", COL_INT},
+		{"VID", COL_BYTES},
+		{"PROVIDERID", COL_INT},
+		{"READERID", COL_INT},
+		{"IP", COL_STRING},
+		{"ACCESSDATE", COL_TIME},
+	}, true},
+	{"audit", []backupColumn{
+		{"ID", COL_INT},
+		{"LOGTYPE", COL_INT},
+		{"LOGDATE", COL_TIME},
+		{"PROVIDERID", COL_INT},
+		{"LOGCOMMENT", COL_STRING},
+	}, true},
+}
+
+// backupFileHeader is the first (unencrypted) line of a backup file
+type backupFileHeader struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	Created   string `json:"created"`
+	Server    string `json:"server"`
+	Encrypted bool   `json:"encrypted"`
+	Salt      []byte `json:"salt,omitempty"`
+}
+
+// backupRecord is one line in the backup stream. The first record
+// contains Tables, the last one contains Counts. All others are rows.
+type backupRecord struct {
+	Tables map[string][]string `json:"tables,omitempty"`
+	AsOf   string              `json:"asof,omitempty"`
+	Table  string              `json:"t,omitempty"`
+	Row    []interface{}       `json:"r,omitempty"`
+	Counts map[string]int      `json:"counts,omitempty"`
+}
+
+// opBackup does the backup function. It writes a consistent snapshot
+// of all vault tables to fileName. If keyFile is given, the backup
+// gets encrypted using the operator key from this file. Use asOf to
+// backup some past point in time (CockroachDB only, eg "-1h").
+func opBackup(fileName string, keyFile string, asOf string) {
+	if _, err := os.Stat(fileName); err == nil {
+		outError("The backup file already exists: " + fileName)
+		return
+	}
+
+	var key []byte
+	var err error
+	if keyFile != "" {
+		key, err = readOperatorKey(keyFile)
+		if err != nil {
+			outError(err.Error())
+			return
+		}
+	}
+
+	// On CockroachDB, all tables are read using the same AS OF SYSTEM
+	// TIME. Other databases use a read only snapshot transaction.
+	ctx := context.Background()
+	var db querier
+	snapshot := ""
+	if isCockroachDB(ctx) {
+		snapshot, err = getSnapshotTime(ctx, asOf)
+		if err != nil {
+			outError(fmt.Sprintf("Invalid asof value: %v", err))
+			return
+		}
+		db = DB
+	} else {
+		if asOf != "" {
+			outError("The asof option is only supported by CockroachDB")
+			return
+		}
+		tx, err := DB.BeginTx(ctx, pgx.TxOptions{
+			IsoLevel:   pgx.RepeatableRead,
+			AccessMode: pgx.ReadOnly,
+		})
+		if err != nil {
+			panic(fmt.Sprintf("Failed to start transaction (backup). Error: %v", err))
+		}
+		defer tx.Rollback(ctx)
+		db = tx
+	}
+
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		outError(fmt.Sprintf("Can not create backup file: %v", err))
+		return
+	}
+
+	counts, err := writeBackup(ctx, file, db, snapshot, key)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(fileName) // do not keep incomplete backups
+		LogInternalf("Failed to create backup %v. Error: %v", fileName, err)
+		DoLog(LOG_TYPE_ERROR, 0, "Failed to create backup "+fileName)
+		outError(fmt.Sprintf("Failed to create backup: %v", err))
+		return
+	}
+
+	DoLog(LOG_TYPE_BACKUP, 0, fmt.Sprintf("Created backup %v (asof %v, rows %v)",
+		fileName, snapshot, counts))
+
+	rResult := make(map[string]interface{})
+	rResult["file"] = fileName
+	rResult["asof"] = snapshot
+	rResult["encrypted"] = key != nil
+	rResult["rows"] = counts
+	outResult(rResult)
+}
+
+// opRestore does the restore function. The whole backup file is
+// verified before anything is written to the database. If dryRun is
+// set, it only verifies and returns the number of rows per table.
+func opRestore(fileName string, keyFile string, dryRun bool) {
+	var key []byte
+	var err error
+	if keyFile != "" {
+		key, err = readOperatorKey(keyFile)
+		if err != nil {
+			outError(err.Error())
+			return
+		}
+	}
+
+	// first pass only verifies the file
+	counts, err := readBackup(fileName, key, nil)
+	if err != nil {
+		DoLog(LOG_TYPE_RESTORE, 0, fmt.Sprintf("Verification of backup %v failed: %v",
+			fileName, err))
+		outError(fmt.Sprintf("Invalid backup file: %v", err))
+		return
+	}
+
+	rResult := make(map[string]interface{})
+	rResult["file"] = fileName
+	rResult["dryrun"] = dryRun
+	rResult["rows"] = counts
+
+	if dryRun {
+		DoLog(LOG_TYPE_RESTORE, 0, fmt.Sprintf("Verified backup %v (dry-run, rows %v)",
+			fileName, counts))
+		outResult(rResult)
+		return
+	}
+
+	// second pass writes the rows
+	restorer := backupRestorer{}
+	_, err = readBackup(fileName, key, restorer.add)
+	if err == nil {
+		err = restorer.flush()
+	}
+	if err == nil {
+		err = restorer.finish()
+	}
+	if err != nil {
+		LogInternalf("Failed to restore backup %v. Error: %v", fileName, err)
+		DoLog(LOG_TYPE_RESTORE, 0, fmt.Sprintf("Restore of backup %v failed after %v rows: %v",
+			fileName, restorer.restored, err))
+		outError(fmt.Sprintf("Failed to restore backup (restored %v rows): %v",
+			restorer.restored, err))
+		return
+	}
+	// restored rows are placed in the default region (see region.go)
+	applyProviderRegions(context.Background())
+
+	DoLog(LOG_TYPE_RESTORE, 0, fmt.Sprintf("Restored backup %v (rows %v)", fileName, counts))
+	outResult(rResult)
+}
+
+// writeBackup writes the complete backup to w and returns the number
+// of rows per table. If no snapshot is given, db is expected
+// to provide a consistent snapshot (transaction).
+func writeBackup(ctx context.Context, w io.Writer, db querier, snapshot string,
+	key []byte) (map[string]int, error) {
+	header := backupFileHeader{
+		Format:    BACKUP_FORMAT,
+		Version:   BACKUP_VERSION,
+		Created:   GetCurrentDateTime(),
+		Server:    SERVER_VERSION,
+		Encrypted: key != nil,
+	}
+	if key != nil {
+		header.Salt = make([]byte, 16)
+		if _, err := rand.Read(header.Salt); err != nil {
+			panic("Can not create random numbers? Weird...")
+		}
+	}
+	j, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(append(j, '\n')); err != nil {
+		return nil, err
+	}
+
+	var body io.Writer = w
+	var crypt *cryptWriter
+	if key != nil {
+		crypt, err = newCryptWriter(w, key, header.Salt)
+		if err != nil {
+			return nil, err
+		}
+		body = crypt
+	}
+	gz := gzip.NewWriter(body)
+	enc := json.NewEncoder(gz)
+
+	tables := make(map[string][]string)
+	for _, t := range backupTables {
+		tables[t.Name] = t.columnNames()
+	}
+	err = enc.Encode(backupRecord{Tables: tables, AsOf: snapshot})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, t := range backupTables {
+		sql := "SELECT " + strings.Join(t.columnNames(), ", ") + " FROM " + t.Name
+		if snapshot != "" {
+			sql += " AS OF SYSTEM TIME '" + snapshot + "'"
+		}
+		rows, err := db.Query(ctx, sql)
+		if err != nil {
+			return nil, err
+		}
+		counts[t.Name] = 0
+		for rows.Next() {
+			values, err := rows.Values()
+			for i, col := range t.Columns {
+				if err == nil && col.Type == COL_STRINGS && values[i] != nil {
+					// arrays are returned as pgtype values
+					var list []string
+					err = assignArray(values[i], &list)
+					values[i] = list
+				}
+				if err == nil && col.Type == COL_INTS && values[i] != nil {
+					var list []int64
+					err = assignArray(values[i], &list)
+					values[i] = list
+				}
+			}
+			if err == nil {
+				err = enc.Encode(backupRecord{Table: t.Name, Row: values})
+			}
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts[t.Name]++
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+	}
+
+	if err = enc.Encode(backupRecord{Counts: counts}); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+	if crypt != nil {
+		if err = crypt.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// readBackup reads and verifies the given backup file. For every row,
+// the handler function is called (if not nil). It returns the number
+// of rows per table.
+func readBackup(fileName string, key []byte,
+	handler func(t *backupTable, columns []string, values []interface{}) error) (map[string]int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.New("missing file header")
+	}
+	var header backupFileHeader
+	if json.Unmarshal(line, &header) != nil || header.Format != BACKUP_FORMAT {
+		return nil, errors.New("this is not a DataVaccinator backup file")
+	}
+	if header.Version != BACKUP_VERSION {
+		return nil, fmt.Errorf("unsupported backup version %v", header.Version)
+	}
+
+	var body io.Reader = reader
+	if header.Encrypted {
+		if key == nil {
+			return nil, errors.New("the backup is encrypted, please provide -keyfile")
+		}
+		body, err = newCryptReader(reader, key, header.Salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(gz)
+	dec.UseNumber()
+
+	var record backupRecord
+	if err = dec.Decode(&record); err != nil || record.Tables == nil {
+		return nil, errors.New("missing table definitions")
+	}
+	// map the columns found in the backup to the known tables
+	names := record.Tables
+	tables := make(map[string]*backupTable)
+	columns := make(map[string][]backupColumn)
+	for name := range names {
+		t := findBackupTable(name)
+		if t == nil {
+			return nil, fmt.Errorf("unknown table %v", name)
+		}
+		for _, n := range names[name] {
+			col, ok := t.column(n)
+			if !ok {
+				return nil, fmt.Errorf("unknown column %v.%v", name, n)
+			}
+			columns[name] = append(columns[name], col)
+		}
+		tables[name] = t
+	}
+
+	counts := make(map[string]int)
+	for {
+		record = backupRecord{}
+		if err = dec.Decode(&record); err != nil {
+			if err == io.EOF {
+				return nil, errors.New("the backup file is incomplete")
+			}
+			return nil, err
+		}
+		if record.Counts != nil {
+			break // reached the end
+		}
+		t, ok := tables[record.Table]
+		if !ok || len(record.Row) != len(columns[record.Table]) {
+			return nil, fmt.Errorf("invalid row for table %v", record.Table)
+		}
+		values := make([]interface{}, len(record.Row))
+		for i, col := range columns[record.Table] {
+			values[i], err = convertBackupValue(col, record.Row[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in %v.%v: %v", t.Name, col.Name, err)
+			}
+		}
+		if handler != nil {
+			if err = handler(t, names[record.Table], values); err != nil {
+				return nil, err
+			}
+		}
+		counts[record.Table]++
+	}
+
+	// compare with the counts stored at the end of the backup
+	for name := range tables {
+		if counts[name] != record.Counts[name] {
+			return nil, fmt.Errorf("table %v has %v rows, expected %v",
+				name, counts[name], record.Counts[name])
+		}
+		counts[name] = record.Counts[name] // also add empty tables
+	}
+	// make sure the rest of the file is valid (checksums, encryption)
+	if _, err = io.Copy(ioutil.Discard, gz); err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(ioutil.Discard, body); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// backupRestorer collects rows and writes them in chunks of
+// CNF_BACKUP_CHUNK_ROWS (one transaction per chunk).
+type backupRestorer struct {
+	table    *backupTable
+	columns  []string
+	rows     [][]interface{}
+	restored int
+	vids     map[string]bool            // VIDs of all restored data rows
+	replaced map[string]map[string]bool // restored VIDs per dependent table
+}
+
+// add is the handler for readBackup
+func (r *backupRestorer) add(t *backupTable, columns []string, values []interface{}) error {
+	if r.table != t || len(r.rows) >= CNF_BACKUP_CHUNK_ROWS {
+		if err := r.flush(); err != nil {
+			return err
+		}
+	}
+	r.table = t
+	r.columns = columns
+	r.rows = append(r.rows, values)
+	return nil
+}
+
+// flush writes all collected rows using one transaction
+func (r *backupRestorer) flush() error {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	params := make([]string, len(r.columns))
+	for i := range r.columns {
+		col, _ := r.table.column(r.columns[i])
+		params[i] = fmt.Sprintf("$%d::%v", i+1, col.sqlType())
+	}
+	var sql string
+	if r.table.HasKey {
+		sql = "UPSERT INTO " + r.table.Name + " (" + strings.Join(r.columns, ", ") +
+			") VALUES (" + strings.Join(params, ", ") + ")"
+	} else {
+		// no primary key, so only insert rows which are not there yet
+		where := make([]string, len(r.columns))
+		for i, name := range r.columns {
+			where[i] = name + "=" + params[i]
+		}
+		sql = "INSERT INTO " + r.table.Name + " (" + strings.Join(r.columns, ", ") +
+			") SELECT " + strings.Join(params, ", ") +
+			" WHERE NOT EXISTS (SELECT 1 FROM " + r.table.Name +
+			" WHERE " + strings.Join(where, " AND ") + ")"
+	}
+
+	vids, err := r.chunkVIDs()
+	if err != nil {
+		return err
+	}
+	replace := r.replaceVIDs(r.table.Name, vids)
+	ctx := context.Background()
+	err = execTx(ctx, "restore", func(tx pgx.Tx) error {
+		if err := deleteDependentRows(ctx, tx, r.table.Name, replace); err != nil {
+			return err
+		}
+		for _, values := range r.rows {
+			if _, err := tx.Exec(ctx, sql, values...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.markVIDs(r.table.Name, vids, replace)
+	r.restored += len(r.rows)
+	r.rows = nil
+	return nil
+}
+
+// finish deletes the current search words and history of all restored
+// VIDs without words or history in the backup (see deleteDependentRows).
+// It is called after all rows are written.
+func (r *backupRestorer) finish() error {
+	ctx := context.Background()
+	for _, table := range dependentTables {
+		var vids [][]byte
+		for vid := range r.vids {
+			if !r.replaced[table][vid] {
+				vids = append(vids, []byte(vid))
+			}
+		}
+		for len(vids) > 0 {
+			n := len(vids)
+			if n > CNF_BACKUP_CHUNK_ROWS {
+				n = CNF_BACKUP_CHUNK_ROWS
+			}
+			err := execTx(ctx, "restore", func(tx pgx.Tx) error {
+				return deleteDependentRows(ctx, tx, table, vids[:n])
+			})
+			if err != nil {
+				return err
+			}
+			vids = vids[n:]
+		}
+	}
+	return nil
+}
+
+// chunkVIDs returns the VIDs of all collected rows of the data table
+// and its dependent tables (nil for other tables).
+func (r *backupRestorer) chunkVIDs() ([][]byte, error) {
+	if r.table.Name != "data" && !isDependentTable(r.table.Name) {
+		return nil, nil
+	}
+	index := -1
+	for i, name := range r.columns {
+		if strings.EqualFold(name, "VID") {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("%v rows without VID", r.table.Name)
+	}
+	vids := make([][]byte, 0, len(r.rows))
+	for _, values := range r.rows {
+		if vid, ok := values[index].([]byte); ok {
+			vids = append(vids, vid)
+		}
+	}
+	return vids, nil
+}
+
+// replaceVIDs returns the restored VIDs of the given chunk of some
+// dependent table whose current rows are not deleted yet.
+func (r *backupRestorer) replaceVIDs(table string, vids [][]byte) [][]byte {
+	if !isDependentTable(table) {
+		return nil
+	}
+	var replace [][]byte
+	seen := make(map[string]bool)
+	for _, vid := range vids {
+		key := string(vid)
+		if r.vids[key] && !r.replaced[table][key] && !seen[key] {
+			replace = append(replace, vid)
+			seen[key] = true
+		}
+	}
+	return replace
+}
+
+// markVIDs remembers the VIDs of some written chunk, either as restored
+// data rows or as replaced rows of some dependent table.
+func (r *backupRestorer) markVIDs(table string, vids, replaced [][]byte) {
+	if table == "data" {
+		if r.vids == nil {
+			r.vids = make(map[string]bool)
+		}
+		for _, vid := range vids {
+			r.vids[string(vid)] = true
+		}
+		return
+	}
+	if len(replaced) == 0 {
+		return
+	}
+	if r.replaced == nil {
+		r.replaced = make(map[string]map[string]bool)
+	}
+	if r.replaced[table] == nil {
+		r.replaced[table] = make(map[string]bool)
+	}
+	for _, vid := range replaced {
+		r.replaced[table][string(vid)] = true
+	}
+}
+
+// columnNames returns the names of all columns of the table
+func (t *backupTable) columnNames() []string {
+	names := make([]string, len(t.Columns))
+	for i, col := range t.Columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// column returns the column definition with the given name
+func (t *backupTable) column(name string) (backupColumn, bool) {
+	for _, col := range t.Columns {
+		if strings.EqualFold(col.Name, name) {
+			return col, true
+		}
+	}
+	return backupColumn{}, false
+}
+
+// dependentTables are the tables whose rows of some restored VID are
+// replaced by the ones of the backup.
+var dependentTables = []string{"search", "history"}
+
+// isDependentTable returns true for the tables in dependentTables
+func isDependentTable(table string) bool {
+	for _, name := range dependentTables {
+		if name == table {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteDependentRows deletes the current rows of the given dependent
+// table for the given VIDs. The search table has no primary key and
+// the backup may not have all revisions, so otherwise a VID updated
+// after the backup would keep newer words and history next to its old
+// payload. The rows are deleted in the same transaction which writes
+// the first rows of the backup for this VID, so a failed restore never
+// leaves some VID without words or history.
+func deleteDependentRows(ctx context.Context, tx pgx.Tx, table string, vids [][]byte) error {
+	if len(vids) == 0 {
+		return nil
+	}
+	sql := "DELETE FROM " + table + " WHERE VID=ANY($1::BYTEA[])"
+	_, err := tx.Exec(ctx, sql, vids)
+	return err
+}
+
+// sqlType returns the SQL type used for casting restore parameters
+func (col backupColumn) sqlType() string {
+	switch col.Type {
+	case COL_INT:
+		return "INT8"
+	case COL_BYTES:
+		return "BYTEA"
+	case COL_TIME:
+		return "TIMESTAMPTZ"
+	case COL_STRINGS:
+		return "TEXT[]"
+	case COL_INTS:
+		return "INT8[]"
+	}
+	return "TEXT"
+}
+
+// findBackupTable returns the table definition with the given name
+func findBackupTable(name string) *backupTable {
+	for i := range backupTables {
+		if backupTables[i].Name == name {
+			return &backupTables[i]
+		}
+	}
+	return nil
+}
+
+// convertBackupValue converts a JSON decoded value back to the
+// type expected by the database column.
+func convertBackupValue(col backupColumn, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch col.Type {
+	case COL_INT:
+		if n, ok := value.(json.Number); ok {
+			return n.Int64()
+		}
+	case COL_BYTES:
+		if s, ok := value.(string); ok {
+			return base64.StdEncoding.DecodeString(s)
+		}
+	case COL_TIME:
+		if s, ok := value.(string); ok {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+	case COL_STRINGS:
+		if list, ok := value.([]interface{}); ok {
+			res := make([]string, len(list))
+			for i, v := range list {
+				if res[i], ok = v.(string); !ok {
+					return nil, errors.New("unexpected array type")
+				}
+			}
+			return res, nil
+		}
+	case COL_INTS:
+		if list, ok := value.([]interface{}); ok {
+			res := make([]int64, len(list))
+			for i, v := range list {
+				n, ok := v.(json.Number)
+				if !ok {
+					return nil, errors.New("unexpected array type")
+				}
+				var err error
+				if res[i], err = n.Int64(); err != nil {
+					return nil, err
+				}
+			}
+			return res, nil
+		}
+	default:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, errors.New("unexpected type")
+}
+
+// assignArray converts some array value returned by rows.Values() (eg
+// pgtype.TextArray) to the given slice.
+func assignArray(value interface{}, dst interface{}) error {
+	switch a := value.(type) {
+	case pgtype.TextArray:
+		return a.AssignTo(dst)
+	case pgtype.VarcharArray:
+		return a.AssignTo(dst)
+	case pgtype.Int8Array:
+		return a.AssignTo(dst)
+	case pgtype.Int4Array:
+		return a.AssignTo(dst)
+	case pgtype.Int2Array:
+		return a.AssignTo(dst)
+	}
+	return fmt.Errorf("unexpected array type %T", value)
+}
+
+// getSnapshotTime returns the timestamp for AS OF SYSTEM TIME usage.
+// asOf can be empty (now), relative (eg "-1h") or some absolute time
+// (eg "2022-05-10 13:40:00").
+func getSnapshotTime(ctx context.Context, asOf string) (string, error) {
+	if asOf == "" {
+		asOf = "-1s" // must not be in the future for all nodes
+	}
+	sql := "SELECT $1::TIMESTAMPTZ"
+	if strings.HasPrefix(asOf, "-") {
+		sql = "SELECT NOW() + $1::INTERVAL"
+	}
+	var t time.Time
+	err := DB.QueryRow(ctx, sql, asOf).Scan(&t)
+	if err != nil {
+		return "", err
+	}
+	if t.After(time.Now()) {
+		return "", errors.New("time is in the future")
+	}
+	return t.UTC().Format("2006-01-02 15:04:05.999999"), nil
+}
+
+// readOperatorKey reads the operator key used for backup encryption
+// from the given file.
+func readOperatorKey(keyFile string) ([]byte, error) {
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Can not read key file: %v", err)
+	}
+	key := []byte(strings.TrimSpace(string(content)))
+	if len(key) < 16 {
+		return nil, errors.New("The operator key must have at least 16 characters")
+	}
+	return key, nil
+}
+
+// newBackupCipher derives the AES-256-GCM cipher from the operator
+// key and the salt.
+func newBackupCipher(key []byte, salt []byte) (cipher.AEAD, error) {
+	derived, err := scrypt.Key(key, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupNonce returns the nonce for the given chunk. The last chunk
+// uses a different nonce to detect truncated files.
+func backupNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// cryptWriter encrypts everything written to it in chunks of
+// CNF_BACKUP_CHUNK_KB. Every encrypted chunk is prefixed by its length.
+// Close must be called to write the last chunk.
+type cryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+func newCryptWriter(w io.Writer, key []byte, salt []byte) (*cryptWriter, error) {
+	aead, err := newBackupCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptWriter{w: w, aead: aead}, nil
+}
+
+// Write implements the io.Writer interface
+func (cw *cryptWriter) Write(p []byte) (int, error) {
+	cw.buf = append(cw.buf, p...)
+	for len(cw.buf) > CNF_BACKUP_CHUNK_KB*1024 {
+		if err := cw.writeChunk(cw.buf[:CNF_BACKUP_CHUNK_KB*1024], false); err != nil {
+			return 0, err
+		}
+		cw.buf = cw.buf[CNF_BACKUP_CHUNK_KB*1024:]
+	}
+	return len(p), nil
+}
+
+// Close writes the remaining data as last chunk
+func (cw *cryptWriter) Close() error {
+	err := cw.writeChunk(cw.buf, true)
+	cw.buf = nil
+	return err
+}
+
+func (cw *cryptWriter) writeChunk(plain []byte, last bool) error {
+	sealed := cw.aead.Seal(nil, backupNonce(cw.counter, last), plain, nil)
+	cw.counter++
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(sealed)))
+	if _, err := cw.w.Write(length); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(sealed)
+	return err
+}
+
+// cryptReader decrypts the chunks written by cryptWriter
+type cryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+func newCryptReader(r io.Reader, key []byte, salt []byte) (*cryptReader, error) {
+	aead, err := newBackupCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptReader{r: r, aead: aead}, nil
+}
+
+// Read implements the io.Reader interface
+func (cr *cryptReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *cryptReader) readChunk() error {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(cr.r, length); err != nil {
+		return errors.New("the backup file is truncated")
+	}
+	size := binary.BigEndian.Uint32(length)
+	if size > uint32(CNF_BACKUP_CHUNK_KB*1024+cr.aead.Overhead()) {
+		return errors.New("invalid chunk size")
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, sealed); err != nil {
+		return errors.New("the backup file is truncated")
+	}
+	plain, err := cr.aead.Open(nil, backupNonce(cr.counter, false), sealed, nil)
+	if err != nil {
+		plain, err = cr.aead.Open(nil, backupNonce(cr.counter, true), sealed, nil)
+		if err != nil {
+			return errors.New("decryption failed (wrong key or modified file)")
+		}
+		cr.done = true
+		// there must not be anything behind the last chunk
+		if n, _ := cr.r.Read(make([]byte, 1)); n > 0 {
+			return errors.New("unexpected data after last chunk")
+		}
+	}
+	cr.counter++
+	cr.buf = plain
+	return nil
+}
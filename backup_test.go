@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCryptWriterReader(t *testing.T) {
+	key := []byte("some operator key for testing")
+	salt := []byte("0123456789abcdef")
+	plain := bytes.Repeat([]byte("DataVaccinator "), CNF_BACKUP_CHUNK_KB*200)
+
+	encrypt := func(data []byte) []byte {
+		var out bytes.Buffer
+		cw, err := newCryptWriter(&out, key, salt)
+		if err != nil {
+			t.Fatalf("newCryptWriter() error = %v", err)
+		}
+		cw.Write(data)
+		if err = cw.Close(); err != nil {
+			t.Fatalf("cryptWriter.Close() error = %v", err)
+		}
+		return out.Bytes()
+	}
+	encrypted := encrypt(plain)
+
+	t.Run("roundtrip", func(t *testing.T) {
+		cr, _ := newCryptReader(bytes.NewReader(encrypted), key, salt)
+		got, err := ioutil.ReadAll(cr)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("cryptReader returned %v bytes (error %v), want %v bytes",
+				len(got), err, len(plain))
+		}
+	})
+	t.Run("empty", func(t *testing.T) {
+		cr, _ := newCryptReader(bytes.NewReader(encrypt(nil)), key, salt)
+		got, err := ioutil.ReadAll(cr)
+		if err != nil || len(got) != 0 {
+			t.Errorf("cryptReader returned %v bytes (error %v), want none", len(got), err)
+		}
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		cr, _ := newCryptReader(bytes.NewReader(encrypted), []byte("some other operator key"), salt)
+		if _, err := ioutil.ReadAll(cr); err == nil {
+			t.Errorf("cryptReader with wrong key returned no error")
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		cut := encrypted[:len(encrypted)-len(encrypted)/3]
+		cr, _ := newCryptReader(bytes.NewReader(cut), key, salt)
+		if _, err := ioutil.ReadAll(cr); err == nil {
+			t.Errorf("cryptReader with truncated data returned no error")
+		}
+	})
+}
+
+func TestConvertBackupValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		col     backupColumn
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{"int", backupColumn{"ID", COL_INT}, json.Number("716134782531600385"), "716134782531600385", false},
+		{"bytes", backupColumn{"VID", COL_BYTES}, "YWJj", "[97 98 99]", false},
+		{"time", backupColumn{"CREATIONDATE", COL_TIME}, "2022-05-10T13:40:47.157329+02:00",
+			"2022-05-10 13:40:47.157329 +0200 +0200", false},
+		{"string", backupColumn{"NAME", COL_STRING}, "test", "test", false},
+		{"null", backupColumn{"LOGCOMMENT", COL_STRING}, nil, "<nil>", false},
+		{"strings", backupColumn{"WORDS", COL_STRINGS}, []interface{}{"ab12", "cd34"}, "[ab12 cd34]", false},
+		{"ints", backupColumn{"READERS", COL_INTS}, []interface{}{json.Number("2"), json.Number("5")}, "[2 5]", false},
+		{"wrong type", backupColumn{"ID", COL_INT}, "123", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertBackupValue(tt.col, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("convertBackupValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if s := fmt.Sprint(got); s != tt.want {
+					t.Errorf("convertBackupValue() = %v, want %v", s, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackupRestorerReplaceVIDs(t *testing.T) {
+	r := backupRestorer{}
+	r.markVIDs("data", [][]byte{[]byte("a"), []byte("b"), []byte("c")}, nil)
+	// words of "a" are split into two chunks, "d" was not restored
+	r.markVIDs("search", nil, r.replaceVIDs("search", [][]byte{[]byte("a"), []byte("a"), []byte("b")}))
+	tests := []struct {
+		name  string
+		table string
+		vids  []string
+		want  string
+	}{
+		{"already replaced", "search", []string{"a", "b"}, "[]"},
+		{"first rows of VID", "search", []string{"a", "c", "c"}, "[c]"},
+		{"not restored", "search", []string{"d"}, "[]"},
+		{"other dependent table", "history", []string{"a", "b"}, "[a b]"},
+		{"no dependent table", "holds", []string{"a"}, "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vids := make([][]byte, len(tt.vids))
+			for i, vid := range tt.vids {
+				vids[i] = []byte(vid)
+			}
+			if got := fmt.Sprintf("%s", r.replaceVIDs(tt.table, vids)); got != tt.want {
+				t.Errorf("replaceVIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
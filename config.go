@@ -2,21 +2,34 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"time"
 )
 
 type Configuration struct {
-	ConnectionString string `json:"connectionString"`
-	MaxConnections   int    `json:"maxConnections"`
-	ListenIPPort     string `json:"listenIPPort"`
-	LetsEncrypt      int    `json:"useLetsEncrypt"`
-	Domain           string `json:"domain"`
-	DebugMode        int    `json:"debugMode"`
-	IPExtractor      string `json:"IPExtractor"`
-	DisableIPCheck   int    `json:"disableIPCheck"`
-	CORSDomains      string `json:"CORSDomains"`
-	RunAs            string `json:"runAs"`
-	CertFolder       string `json:"certFolder"`
+	ConnectionString string         `json:"connectionString"`
+	MaxConnections   int            `json:"maxConnections"`
+	ListenIPPort     string         `json:"listenIPPort"`
+	LetsEncrypt      int            `json:"useLetsEncrypt"`
+	Domain           string         `json:"domain"`
+	DebugMode        int            `json:"debugMode"`
+	IPExtractor      string         `json:"IPExtractor"`
+	DisableIPCheck   int            `json:"disableIPCheck"`
+	CORSDomains      string         `json:"CORSDomains"`
+	RunAs            string         `json:"runAs"`
+	CertFolder       string         `json:"certFolder"`
+	IdempotencyHours int            `json:"idempotencyHours"`
+	SearchComplexity int            `json:"searchComplexity"`
+	MetricsIPs       string         `json:"metricsIPs"`
+	QueryTimeout     int            `json:"queryTimeout"`
+	RequestTimeout   int            `json:"requestTimeout"`
+	OpTimeouts       map[string]int `json:"opTimeouts"`
+	ReadTimeout      int            `json:"readTimeout"`
+	WriteTimeout     int            `json:"writeTimeout"`
+	IdleTimeout      int            `json:"idleTimeout"`
+	FollowerReads    map[string]int `json:"followerReads"`
+	MultiRegion      int            `json:"multiRegion"`
 }
 
 var cfg Configuration
@@ -33,4 +46,43 @@ func loadConfig() {
 	if err != nil {
 		panic("Invalid config.json")
 	}
+	if err = checkTimeouts(); err != nil {
+		panic("Invalid config.json: " + err.Error())
+	}
+}
+
+// checkTimeouts returns an error if writeTimeout is not larger than all
+// request deadlines. Otherwise, the server would cut off the response
+// of slow requests before the client gets DV_TIMEOUT.
+func checkTimeouts() error {
+	writeTimeout := getTimeout(cfg.WriteTimeout, CNF_WRITE_TIMEOUT_SEC)
+	deadline := getTimeout(cfg.RequestTimeout, CNF_REQUEST_TIMEOUT_SEC)
+	for op := range cfg.OpTimeouts {
+		if t := getOpTimeout(op); t > deadline {
+			deadline = t
+		}
+	}
+	if writeTimeout <= deadline {
+		return fmt.Errorf("writeTimeout (%v) must be larger than requestTimeout and all opTimeouts (%v)",
+			writeTimeout, deadline)
+	}
+	return nil
+}
+
+// getTimeout returns the given configuration value (seconds) as
+// duration. If not set (<1), the given default is used.
+func getTimeout(seconds int, defaultSeconds int) time.Duration {
+	if seconds < 1 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getOpTimeout returns the deadline for the given API operation. It is
+// taken from opTimeouts, with requestTimeout as fallback.
+func getOpTimeout(op string) time.Duration {
+	if seconds, ok := cfg.OpTimeouts[op]; ok && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return getTimeout(cfg.RequestTimeout, CNF_REQUEST_TIMEOUT_SEC)
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetOpTimeout(t *testing.T) {
+	cfg = Configuration{RequestTimeout: 20, OpTimeouts: map[string]int{"search": 45, "get": 0}}
+	defer func() { cfg = Configuration{} }()
+	tests := []struct {
+		op   string
+		want time.Duration
+	}{
+		{"search", 45 * time.Second},
+		{"get", 20 * time.Second},
+		{"add", 20 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.op, func(t *testing.T) {
+			if got := getOpTimeout(tt.op); got != tt.want {
+				t.Errorf("getOpTimeout(%v) = %v, want %v", tt.op, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTimeouts(t *testing.T) {
+	defer func() { cfg = Configuration{} }()
+	tests := []struct {
+		name    string
+		cfg     Configuration
+		wantErr bool
+	}{
+		{"defaults", Configuration{}, false},
+		{"larger request timeout", Configuration{RequestTimeout: 60}, true},
+		{"larger op timeout", Configuration{OpTimeouts: map[string]int{"search": 90}}, true},
+		{"larger write timeout", Configuration{WriteTimeout: 120, OpTimeouts: map[string]int{"search": 90}},
+			false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg = tt.cfg
+			if err := checkTimeouts(); (err != nil) != tt.wantErr {
+				t.Errorf("checkTimeouts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -4,6 +4,19 @@ package main
 This file contains generic configuration constants
 */
 
+// Maximum number of VIDs returned per search call (hard cap for limit)
+const CNF_MAX_SEARCH_RESULTS = 1000
+
+// Maximum number of matches counted per search call (total)
+const CNF_MAX_SEARCH_COUNT = 10000
+
+// Default maximum number of terms and operators in structured search
+// queries (see searchComplexity in config)
+const CNF_MAX_SEARCH_COMPLEXITY = 16
+
+// Maximum nesting level of structured search queries
+const CNF_MAX_SEARCH_DEPTH = 4
+
 // Maximum payload per Add/Publish function in MB
 const CNF_MAX_PAYLOAD_MB = 1
 
@@ -12,3 +25,100 @@ const CNF_MAX_PUBLISH_DAYS = 365
 
 // Maximum number of words to search for in one call
 const CNF_MAX_SEARCH_TERMS = 5
+
+// Maximum number of search words per VID (addwords, default of
+// checksearch)
+const CNF_MAX_WORDS_PER_VID = 100
+
+// Maximum number of findings listed per check (checksearch)
+const CNF_CHECK_REPORT_ROWS = 100
+
+// Number of VIDs or words repaired per chunk (checksearch)
+const CNF_REPAIR_CHUNK_ROWS = 500
+
+// Maximum number of tries for transactions failing with serialization
+// errors (CockroachDB error 40001)
+const CNF_MAX_TX_RETRIES = 5
+
+// Wait time before the first retry of some transaction in milliseconds.
+// It doubles with every retry up to CNF_TX_MAX_BACKOFF_MS.
+const CNF_TX_BACKOFF_MS = 10
+
+// Maximum wait time between retries of some transaction in milliseconds
+const CNF_TX_MAX_BACKOFF_MS = 1000
+
+// Default timeout for database statements in seconds (see queryTimeout
+// in config)
+const CNF_QUERY_TIMEOUT_SEC = 30
+
+// Default deadline for API requests in seconds (see requestTimeout and
+// opTimeouts in config)
+const CNF_REQUEST_TIMEOUT_SEC = 30
+
+// Default time for reading a request incl. body in seconds (see
+// readTimeout in config)
+const CNF_READ_TIMEOUT_SEC = 30
+
+// Default time for handling a request and writing the response in
+// seconds (see writeTimeout in config)
+const CNF_WRITE_TIMEOUT_SEC = 60
+
+// Default time keep-alive connections stay open without requests in
+// seconds (see idleTimeout in config)
+const CNF_IDLE_TIMEOUT_SEC = 120
+
+// Maximum staleness of follower reads a service provider can allow in
+// seconds (see maxstaleness of add and update ops)
+const CNF_MAX_STALENESS_SEC = 3600
+
+// Number of rows moved per chunk and table (setregion)
+const CNF_REGION_CHUNK_ROWS = 500
+
+// Number of prepared statements cached per database connection
+const CNF_STATEMENT_CACHE_SIZE = 512
+
+// Interval for checking the health of idle database connections in
+// seconds
+const CNF_DB_HEALTH_CHECK_SEC = 60
+
+// Idle database connections are closed after this time in seconds
+const CNF_DB_MAX_IDLE_SEC = 300
+
+// Number of rows restored per transaction (restore of backups)
+const CNF_BACKUP_CHUNK_ROWS = 500
+
+// Size of encrypted chunks in backup files in KB
+const CNF_BACKUP_CHUNK_KB = 64
+
+// Maximum number of items per batch operation (eg addbatch)
+const CNF_MAX_BATCH_ITEMS = 1000
+
+// Maximum payload of all items per batch operation in MB
+const CNF_MAX_BATCH_PAYLOAD_MB = 20
+
+// Number of items inserted per transaction in batch operations
+const CNF_BATCH_CHUNK_SIZE = 100
+
+// Maximum number of previous versions kept per VID (history)
+const CNF_MAX_HISTORY_VERSIONS = 100
+
+// Maximum number of days for the retention of regular entries (expiry)
+const CNF_MAX_RETENTION_DAYS = 36500
+
+// Maximum number of expired or purged entries deleted per transaction (cleanup)
+const CNF_EXPIRE_CHUNK_ROWS = 1000
+
+// Maximum number of reads allowed for some published entry (maxreads)
+const CNF_MAX_PUBLISH_READS = 1000000
+
+// Number of days the access log of published entries is kept
+const CNF_PUBLISH_ACCESS_DAYS = 400
+
+// Timeout for webhook calls in seconds
+const CNF_WEBHOOK_TIMEOUT_SEC = 10
+
+// Maximum number of days deleted entries can get restored (undelete)
+const CNF_MAX_DELETE_GRACE_DAYS = 365
+
+// Default hours an idempotency key is valid (see idempotencyHours in config)
+const CNF_IDEMPOTENCY_HOURS = 24
@@ -9,32 +9,42 @@ package main
 //    bcrypt or sha2 hashed passwords for every request.
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/big"
 	"net"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/jackc/pgx"
-	"github.com/jackc/pgx/pgtype"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-var DB *pgx.ConnPool
+var DB *pgxpool.Pool
 var DBHost string
+var DBIsCockroach bool
+
+// querier is implemented by *pgxpool.Pool and pgx.Tx, so reads work
+// with and without transaction
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
 
 func initDatabase() bool {
 	// Set client connection
-	var poolConfig pgx.ConnPoolConfig
-	config, err := pgx.ParseConnectionString(cfg.ConnectionString)
+	poolConfig, err := pgxpool.ParseConfig(cfg.ConnectionString)
 	if err != nil {
 		panic("Can not parse your connection string")
 	}
 
-	poolConfig.ConnConfig = config
-	poolConfig.AcquireTimeout = time.Minute
-
 	maxConn := cfg.MaxConnections
 	if maxConn < 1 {
 		// <1 is auto, which uses CPU cores (incl. hyperthreading) * 3
@@ -44,10 +54,30 @@ func initDatabase() bool {
 		maxConn = runtime.NumCPU() * 3
 	}
 
-	poolConfig.MaxConnections = maxConn
+	poolConfig.MaxConns = int32(maxConn)
+
+	// The pool checks idle connections regularly and replaces broken
+	// ones. Without, we start getting errors like "write tcp
+	// 10.0.0.10:34678->10.0.0.10:26257: write: broken pipe".
+	poolConfig.HealthCheckPeriod = CNF_DB_HEALTH_CHECK_SEC * time.Second
+	poolConfig.MaxConnIdleTime = CNF_DB_MAX_IDLE_SEC * time.Second
+
+	// Cache prepared statements per connection
+	poolConfig.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+		return stmtcache.New(conn, stmtcache.ModePrepare, CNF_STATEMENT_CACHE_SIZE)
+	}
+
+	// Statements of API requests are cancelled by the database after
+	// queryTimeout (unless already given by the connection string).
+	// Commandline operations and cleanup run without statement timeout,
+	// they may need to scan whole tables.
+	if _, ok := poolConfig.ConnConfig.RuntimeParams["statement_timeout"]; !ok {
+		poolConfig.BeforeAcquire = setStatementTimeout
+	}
 
 	// Connect to CockroachDB
-	DB, err = pgx.NewConnPool(poolConfig)
+	ctx := context.Background()
+	DB, err = pgxpool.ConnectConfig(ctx, poolConfig)
 	if err != nil {
 		fmt.Printf("\n%v\n", err)
 		panic("Can not connect new pool to CockroachDB")
@@ -55,25 +85,77 @@ func initDatabase() bool {
 
 	// Check the connection
 	var w int
-	err = DB.QueryRow("SELECT COUNT(*) FROM provider").Scan(&w)
+	err = DB.QueryRow(ctx, "SELECT COUNT(*) FROM provider").Scan(&w)
 	if err != nil {
 		fmt.Printf("\n%v\n", err)
 		panic("Test query to 'provider' table failed. Maybe no entries?")
 	}
 
 	// keep DB host in global variable for later use (eg in main() function)
-	DBHost = config.Host
+	DBHost = poolConfig.ConnConfig.Host
+	DBIsCockroach = isCockroachDB(ctx)
 
 	return true
 }
 
+// apiRequestKey marks the contexts of API requests (see withAPIRequest)
+type apiRequestKey struct{}
+
+// connTimeouts keeps the current statement_timeout per connection
+var connTimeouts sync.Map // *pgx.Conn -> time.Duration
+
+// withAPIRequest returns the given context marked as API request. All
+// statements using it get the statement timeout (see queryTimeout).
+func withAPIRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, apiRequestKey{}, true)
+}
+
+// getStatementTimeout returns the statement timeout for the given
+// context. It is 0 (no timeout) if not used by some API request.
+func getStatementTimeout(ctx context.Context) time.Duration {
+	if api, _ := ctx.Value(apiRequestKey{}).(bool); !api {
+		return 0
+	}
+	return getTimeout(cfg.QueryTimeout, CNF_QUERY_TIMEOUT_SEC)
+}
+
+// setStatementTimeout changes the statement_timeout of the given
+// connection before it is used with the given context (if needed).
+// It returns false if the connection failed and must not be used.
+func setStatementTimeout(ctx context.Context, conn *pgx.Conn) bool {
+	timeout := getStatementTimeout(ctx)
+	current, known := connTimeouts.Load(conn)
+	if !known && timeout == 0 {
+		return true // new connections have no timeout
+	}
+	if known && current.(time.Duration) == timeout {
+		return true
+	}
+	sql := "SET statement_timeout = " + strconv.FormatInt(timeout.Milliseconds(), 10)
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		return false
+	}
+	connTimeouts.Store(conn, timeout)
+
+	// forget connections closed by the pool meanwhile
+	connTimeouts.Range(func(key, value interface{}) bool {
+		if key.(*pgx.Conn).IsClosed() {
+			connTimeouts.Delete(key)
+		}
+		return true
+	})
+	return true
+}
+
 // shutdownDatabase closes all database connections for clean shutdown
 func shutdownDatabase() {
 	DB.Close()
 }
 
 // cleanupHeartBeat is called async to find and delete expired
-// published entries in the database every hour.
+// published entries, expired regular entries, deleted entries beyond
+// their grace period, idempotency keys and old access logs of published
+// entries in the database every hour.
 //
 // In order to prevent multiple vaccinator instances in a cluster
 // calling the same deletion at the same time or to often,
@@ -99,11 +181,12 @@ func cleanupHeartBeat() {
 		fmt.Println("My NODEID value is: " + strconv.Itoa(IPVal))
 	}
 
+	ctx := context.Background()
 	for range time.Tick(time.Hour) {
 		// Do checks every hour
 
 		sql := `UPSERT INTO nodes(NODEID, LASTACTIVITY) VALUES($1, NOW())`
-		_, err = DB.Exec(sql, IPVal)
+		_, err = DB.Exec(ctx, sql, IPVal)
 		if err != nil {
 			LogInternalf("Failed to add/update nodes entry: %v", err)
 			continue
@@ -111,15 +194,15 @@ func cleanupHeartBeat() {
 
 		sql = `DELETE FROM nodes 
 					WHERE LASTACTIVITY < NOW() - INTERVAL '60 minutes'`
-		_, err = DB.Exec(sql)
+		_, err = DB.Exec(ctx, sql)
 		if err != nil {
 			LogInternalf("Failed to cleanup outdated nodes: %v", err)
 			continue
 		}
 
 		sql = `SELECT MIN(NODEID) AS NODEID FROM nodes`
-		var rows *pgx.Rows
-		rows, err = DB.Query(sql)
+		var rows pgx.Rows
+		rows, err = DB.Query(ctx, sql)
 		if err != nil {
 			LogInternalf("Failed to get available nodes: %v", err)
 			continue
@@ -157,14 +240,112 @@ func cleanupHeartBeat() {
 						WHERE DURATION > 0 AND
 						NOW() > CREATIONDATE + CONCAT(DURATION::text, ' days')::INTERVAL`
 		*/
+		// Published entries with EXPIRES (republish) are deleted by
+		// cleanupData below.
 		sql = `DELETE FROM data
-					WHERE DURATION > 0 AND
-					CAST(NOW() - CREATIONDATE AS INT) > DURATION * 86400`
-		_, err = DB.Exec(sql)
+					WHERE DURATION > 0 AND EXPIRES IS NULL AND
+					CAST(NOW() - CREATIONDATE AS INT) > DURATION * 86400 AND ` +
+			SQL_NOT_ON_HOLD
+		_, err = DB.Exec(ctx, sql)
 		if err != nil {
 			LogInternalf("Failed to delete published and expired data (cleanupHeartBeat): %v",
 				err)
-			continue
+		}
+
+		cleanupData(ctx, "EXPIRES < NOW()", LOG_TYPE_EXPIRE)
+		cleanupData(ctx, `DELETED < NOW() - (SELECT p.DELETEGRACEDAYS FROM provider p
+						WHERE p.PROVIDERID = data.PROVIDERID) * INTERVAL '1 day'`,
+			LOG_TYPE_PURGE)
+		cleanupData(ctx, "MAXREADS > 0 AND READS >= MAXREADS", LOG_TYPE_DELETE)
+		cleanupHistory(ctx)
+		cleanupIdempotencyKeys(ctx)
+		cleanupPublishAccess(ctx)
+	}
+}
+
+// cleanupData deletes all entries matching the given condition (eg
+// expired ones), together with their search words and history. Entries
+// on legal hold are skipped. It is called by cleanupHeartBeat.
+func cleanupData(ctx context.Context, condition string, logType int) {
+	for {
+		count, err := deleteDataChunk(ctx, condition, logType)
+		if err != nil {
+			LogInternalf("Failed to delete data (cleanupHeartBeat, type %d): %v", logType, err)
+			return
+		}
+		if count < CNF_EXPIRE_CHUNK_ROWS {
+			return // done
+		}
+	}
+}
+
+// deleteDataChunk deletes up to CNF_EXPIRE_CHUNK_ROWS entries matching
+// the given condition using one transaction. The deleted VIDs are logged
+// for every provider using the given logType. It returns the number of
+// deleted entries.
+func deleteDataChunk(ctx context.Context, condition string, logType int) (int, error) {
+	var vids []string
+	var provVids map[int][]string // VIDs per provider for logging
+	err := execTx(ctx, "cleanup", func(tx pgx.Tx) error {
+		sql := `SELECT VID, PROVIDERID FROM data
+					WHERE ` + condition + ` AND ` + SQL_NOT_ON_HOLD + ` LIMIT $1`
+		rows, err := tx.Query(ctx, sql, CNF_EXPIRE_CHUNK_ROWS)
+		if err != nil {
+			return err
+		}
+		vids = []string{}
+		provVids = make(map[int][]string)
+		for rows.Next() {
+			var vid pgtype.Varchar
+			var pid int
+			err = rows.Scan(&vid, &pid)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			vids = append(vids, vid.String)
+			provVids[pid] = append(provVids[pid], vid.String)
+		}
+		rows.Close()
+		if rows.Err() != nil || len(vids) == 0 {
+			return rows.Err()
+		}
+
+		for _, table := range []string{"search", "history", "data"} {
+			sql = "DELETE FROM " + table + " WHERE VID=ANY($1::BYTES[])"
+			_, err = tx.Exec(ctx, sql, VIDArray(vids))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for pid, list := range provVids {
+		go DoLog(logType, pid, strings.Join(list, " "))
+	}
+	return len(vids), nil
+}
+
+// cleanupHistory deletes all versions exceeding the HISTORY setting of
+// their provider in chunks of CNF_EXPIRE_CHUNK_ROWS. Updates already
+// do this for their VID, so this is only needed after the setting got
+// reduced. It is called by cleanupHeartBeat.
+func cleanupHistory(ctx context.Context) {
+	sql := `DELETE FROM history h WHERE h.REVISION <
+				(SELECT d.REVISION - p.HISTORY FROM data d, provider p
+				WHERE d.VID = h.VID AND p.PROVIDERID = d.PROVIDERID) LIMIT $1`
+	for {
+		ctag, err := DB.Exec(ctx, sql, CNF_EXPIRE_CHUNK_ROWS)
+		if err != nil {
+			LogInternalf("Failed to delete exceeding history (cleanupHeartBeat): %v", err)
+			return
+		}
+		if ctag.RowsAffected() < CNF_EXPIRE_CHUNK_ROWS {
+			return // done
 		}
 	}
 }
@@ -190,20 +371,20 @@ func getMyIPVal() (int, error) {
 	return strconv.Atoi(myVal)
 }
 
-// keepAliveHeartBeat is called async to keep the DB connections
-// to CockroachDB up and running. Without, we start getting errors
-// like "write tcp 10.0.0.10:34678->10.0.0.10:26257: write: broken pipe"
-func keepAliveHeartBeat() {
-	for range time.Tick(time.Minute) {
-		// Do checks every minute
+// isCockroachDB returns true if the connected database is CockroachDB
+func isCockroachDB(ctx context.Context) bool {
+	var version string
+	DB.QueryRow(ctx, "SELECT version()").Scan(&version)
+	return strings.Contains(version, "CockroachDB")
+}
 
-		if cfg.DebugMode > 0 {
-			fmt.Printf("Ping database connection.\n")
-		}
-		// Check database availability
-		_, err := DB.Exec(";")
-		if err != nil {
-			fmt.Println("WARN: Database ping was not successful")
-		}
+// getPgErrorCode returns the SQLSTATE code of the given database error
+// (eg "23505" for duplicate keys). It returns an empty string for all
+// other errors.
+func getPgErrorCode(err error) string {
+	var pge *pgconn.PgError
+	if errors.As(err, &pge) {
+		return pge.Code
 	}
+	return ""
 }
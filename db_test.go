@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetStatementTimeout(t *testing.T) {
+	cfg = Configuration{QueryTimeout: 5}
+	defer func() { cfg = Configuration{} }()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want time.Duration
+	}{
+		{"commandline or cleanup", context.Background(), 0},
+		{"api request", withAPIRequest(context.Background()), 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getStatementTimeout(tt.ctx); got != tt.want {
+				t.Errorf("getStatementTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"context"
+	"errors"
+)
+
 /*
 code 	desc 					status
 1 		Missing Parameters. 	INVALID
@@ -11,6 +16,11 @@ code 	desc 					status
 7 		Not found (vid is not found in the system). 	INVALID
 8 		Invalid partner (you are not allowed to access foreign data). 	INVALID
 9 		Invalid parameter size (some parameter exceeds limits). 	INVALID
+10 		Not allowed for published data. 	INVALID
+11 		Conflict (entry was modified in the meantime). 	INVALID
+12 		Idempotency key already used or in progress. 	INVALID
+13 		Entry is on legal hold. 	INVALID
+14 		Timeout (the operation took too long). 	ERROR
 99 		Some internal service error happened. Please contact support. 	ERROR
 */
 
@@ -25,5 +35,63 @@ const (
 	DV_INVALID_PARTNER       = 8
 	DV_INVALID_PARAMSIZE     = 9
 	DV_INVALID_FOR_PUBLISHED = 10
+	DV_REVISION_CONFLICT     = 11
+	DV_IDEMPOTENCY_KEY_USED  = 12
+	DV_LEGAL_HOLD            = 13
+	DV_TIMEOUT               = 14
 	DV_INTERNAL_ERROR        = 99
 )
+
+// dvError is some error which is sent to the client with the given
+// DV_x code and description. For internal errors, err is the cause.
+type dvError struct {
+	code int
+	desc string
+	err  error
+}
+
+func (e *dvError) Error() string {
+	if e.err != nil {
+		return e.desc + " (" + e.err.Error() + ")"
+	}
+	return e.desc
+}
+
+func (e *dvError) Unwrap() error {
+	return e.err
+}
+
+// getTxErrorDetails returns the DV_x code and description for the given
+// error of some transaction (see execTx). Errors other than *dvError
+// are logged and returned as DV_INTERNAL_ERROR. Timeouts result in
+// DV_TIMEOUT, also if wrapped by some internal *dvError.
+func getTxErrorDetails(err error, op string) (int, string) {
+	var dve *dvError
+	if errors.As(err, &dve) && !(dve.code == DV_INTERNAL_ERROR && isTimeoutError(dve.err)) {
+		return dve.code, dve.desc
+	}
+	if isTimeoutError(err) {
+		LogInternalf("Transaction timed out (%v). Error: %v", op, err)
+	} else {
+		LogInternalf("Failed to commit transaction (%v). Error: %v", op, err)
+	}
+	return getDBErrorDetails(err, "Failed to store changes. Contact our support.")
+}
+
+// getDBErrorDetails returns the error code and description for the
+// given database error. Timeouts (see isTimeoutError) result in
+// DV_TIMEOUT, all other errors in DV_INTERNAL_ERROR with the given
+// description.
+func getDBErrorDetails(err error, desc string) (int, string) {
+	if isTimeoutError(err) {
+		return DV_TIMEOUT, "The operation took too long. Please try again."
+	}
+	return DV_INTERNAL_ERROR, desc
+}
+
+// isTimeoutError returns true if the given error was caused by some
+// deadline (see requestTimeout and opTimeouts) or by the statement
+// timeout of the database (see queryTimeout).
+func isTimeoutError(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || getPgErrorCode(err) == "57014"
+}
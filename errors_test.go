@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestGetDBErrorDetails(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), DV_TIMEOUT},
+		{"statement timeout", &pgconn.PgError{Code: "57014"}, DV_TIMEOUT},
+		{"other database error", &pgconn.PgError{Code: "23505"}, DV_INTERNAL_ERROR},
+		{"other error", errors.New("broken pipe"), DV_INTERNAL_ERROR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := getDBErrorDetails(tt.err, "failed"); got != tt.want {
+				t.Errorf("getDBErrorDetails() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTxErrorDetails(t *testing.T) {
+	timeout := &pgconn.PgError{Code: "57014"}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"statement timeout", timeout, DV_TIMEOUT},
+		{"wrapped statement timeout", &dvError{DV_INTERNAL_ERROR, "Failed to read", timeout}, DV_TIMEOUT},
+		{"wrapped deadline", fmt.Errorf("tx: %w", &dvError{DV_INTERNAL_ERROR, "Failed to read",
+			fmt.Errorf("query: %w", context.DeadlineExceeded)}), DV_TIMEOUT},
+		{"internal error", &dvError{DV_INTERNAL_ERROR, "Failed to read", errors.New("broken pipe")},
+			DV_INTERNAL_ERROR},
+		{"request error", &dvError{DV_INVALID_PARAMSIZE, "Too many search words", nil},
+			DV_INVALID_PARAMSIZE},
+		{"other error", errors.New("broken pipe"), DV_INTERNAL_ERROR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := getTxErrorDetails(tt.err, "test"); got != tt.want {
+				t.Errorf("getTxErrorDetails() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+/*
+This file contains the follower reads of the get and search operations.
+Clients ask for them using the "stale" flag. Then, the data is read in
+some read only transaction using a timestamp in the past (see
+follower_read_timestamp() of CockroachDB). This allows CockroachDB to
+serve the read from the nearest replica instead of the leaseholder,
+but changes of the last seconds may be missing.
+
+Follower reads have to be allowed for the operation (followerReads in
+config.json) and for the service provider (maxstaleness, see
+commandline). The data read is never older than the smaller of both
+values. Otherwise, or on other databases, the read is consistent as
+usual.
+*/
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// staleReader is used for reading data in get and search
+type staleReader struct {
+	db        querier       // DB or some read only transaction
+	tx        pgx.Tx        // nil for consistent reads
+	requested bool          // the client asked for follower reads
+	staleness time.Duration // age of the data read (0 if consistent)
+}
+
+// newStaleReader returns the reader for the given operation. If the
+// client asked for follower reads and they are allowed, it uses some
+// read only transaction in the past. Otherwise, it uses DB. Call close
+// after reading.
+func newStaleReader(c echo.Context, op string, request map[string]interface{}) (*staleReader, error) {
+	r := &staleReader{db: DB, requested: GetBool(request["stale"], false)}
+	maxStaleness := getMaxStaleness(c, op)
+	if !r.requested || !DBIsCockroach || maxStaleness <= 0 {
+		return r, nil
+	}
+
+	ctx := c.Request().Context()
+	var ts, now time.Time
+	err := DB.QueryRow(ctx, "SELECT follower_read_timestamp(), now()").Scan(&ts, &now)
+	if err != nil {
+		return nil, err
+	}
+	if now.Sub(ts) > maxStaleness {
+		return r, nil // follower reads are not possible that fresh
+	}
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sql := "SET TRANSACTION AS OF SYSTEM TIME '" +
+		ts.UTC().Format("2006-01-02 15:04:05.999999") + "'"
+	if _, err = tx.Exec(ctx, sql); err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+	r.db = tx
+	r.tx = tx
+	r.staleness = now.Sub(ts)
+	return r, nil
+}
+
+// close ends the read only transaction (if any)
+func (r *staleReader) close(ctx context.Context) {
+	if r.tx != nil {
+		r.tx.Rollback(ctx) // nothing to commit
+		r.tx = nil
+	}
+}
+
+// addResult adds the staleness in milliseconds to the given result if
+// the client asked for follower reads.
+func (r *staleReader) addResult(rResult map[string]interface{}) {
+	if r.requested {
+		rResult["staleness"] = r.staleness.Milliseconds()
+	}
+}
+
+// getMaxStaleness returns the maximum age of data allowed for the given
+// operation and the service provider of the request. It is 0 if
+// follower reads are not allowed.
+func getMaxStaleness(c echo.Context, op string) time.Duration {
+	if op != "get" && op != "search" {
+		return 0 // eg getpublished, which counts reads
+	}
+	opSeconds := cfg.FollowerReads[op]
+	sidSeconds, _ := c.Get("maxstaleness").(int)
+	if opSeconds < 1 || sidSeconds < 1 {
+		return 0
+	}
+	if sidSeconds < opSeconds {
+		return time.Duration(sidSeconds) * time.Second
+	}
+	return time.Duration(opSeconds) * time.Second
+}
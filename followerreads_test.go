@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestGetMaxStaleness(t *testing.T) {
+	cfg = Configuration{FollowerReads: map[string]int{"get": 10, "search": 30}}
+	defer func() { cfg = Configuration{} }()
+	tests := []struct {
+		name         string
+		op           string
+		maxStaleness interface{} // of the provider
+		want         time.Duration
+	}{
+		{"provider smaller", "search", 20, 20 * time.Second},
+		{"operation smaller", "get", 20, 10 * time.Second},
+		{"provider not allowed", "get", 0, 0},
+		{"provider unknown", "get", nil, 0},
+		{"operation not allowed", "getpublished", 20, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echo.New().NewContext(httptest.NewRequest("POST", "/", nil), httptest.NewRecorder())
+			if tt.maxStaleness != nil {
+				c.Set("maxstaleness", tt.maxStaleness)
+			}
+			if got := getMaxStaleness(c, tt.op); got != tt.want {
+				t.Errorf("getMaxStaleness() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
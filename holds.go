@@ -0,0 +1,154 @@
+package main
+
+/*
+This file contains the handling of legal holds. A VID on hold can not
+get updated or deleted, neither by the service provider nor by the
+cleanup (expiry, purge) or the removal of the service provider. Holds
+are managed using the commandline (see hold, release and holds ops)
+and end automatically at their UNTIL date.
+*/
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// SQL condition to exclude all VIDs on hold from the data table
+const SQL_NOT_ON_HOLD = `NOT EXISTS (SELECT 1 FROM holds h
+							WHERE h.VID = data.VID AND h.UNTIL > NOW())`
+
+// getHeldVID returns the first VID of the given list and provider sid
+// which is on legal hold. It returns an empty string if there is none.
+// VIDs of other providers are ignored.
+func getHeldVID(ctx context.Context, db querier, sid int, vids []string) (string, error) {
+	var vid pgtype.Varchar
+	sql := `SELECT VID FROM holds WHERE VID=ANY($1::BYTES[]) AND PROVIDERID=$2 AND
+				UNTIL > NOW() LIMIT 1`
+	err := db.QueryRow(ctx, sql, VIDArray(vids), sid).Scan(&vid)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return vid.String, err
+}
+
+// countHolds returns the number of active holds of the provider sid
+func countHolds(ctx context.Context, db querier, sid int) (int, error) {
+	held := 0
+	sql := "SELECT COUNT(*) FROM holds WHERE PROVIDERID=$1 AND UNTIL > NOW()"
+	err := db.QueryRow(ctx, sql, sid).Scan(&held)
+	return held, err
+}
+
+// opHold does the hold function. It puts one VID on legal hold or
+// changes the reason and date of an existing hold.
+func opHold(request map[string]interface{}) {
+	ctx := context.Background()
+	vid := GetString(request["vid"], "")
+	reason := GetString(request["reason"], "")
+	until := GetString(request["until"], "")
+
+	if !ValidateVID(vid) {
+		outError("Invalid vid parameter")
+		return
+	}
+	if reason == "" {
+		outError("Missing reason parameter")
+		return
+	}
+	untilTime, err := ParseExpiry(until, 0)
+	if err != nil || untilTime.IsZero() {
+		outError("Invalid until parameter (use some future YYYY-MM-DD or YYYY-MM-DD HH:MM:SS)")
+		return
+	}
+
+	sid := 0
+	sql := "SELECT PROVIDERID FROM data WHERE VID=$1"
+	DB.QueryRow(ctx, sql, vid).Scan(&sid)
+	if sid < 1 {
+		outError("Entry with this VID not found")
+		return
+	}
+
+	sql = `UPSERT INTO holds (VID, PROVIDERID, REASON, UNTIL, CREATIONDATE)
+			VALUES ($1, $2, $3, $4, NOW())`
+	_, err = DB.Exec(ctx, sql, vid, sid, reason, untilTime)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to store hold with SQL: [%v] Error: %v", sql, err))
+	}
+
+	DoLog(LOG_TYPE_HOLD, sid, fmt.Sprintf("%v on hold until %v (reason: %v)",
+		vid, FormatDateTime(untilTime), reason))
+	outResult(nil)
+}
+
+// opRelease does the release function. It ends the legal hold of
+// one VID.
+func opRelease(request map[string]interface{}) {
+	ctx := context.Background()
+	vid := GetString(request["vid"], "")
+	reason := GetString(request["reason"], "")
+
+	if !ValidateVID(vid) {
+		outError("Invalid vid parameter")
+		return
+	}
+	if reason == "" {
+		outError("Missing reason parameter")
+		return
+	}
+
+	sid := 0
+	sql := "DELETE FROM holds WHERE VID=$1 RETURNING PROVIDERID"
+	err := DB.QueryRow(ctx, sql, vid).Scan(&sid)
+	if err == pgx.ErrNoRows {
+		outError("This VID is not on hold")
+		return
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Failed to release hold with SQL: [%v] Error: %v", sql, err))
+	}
+
+	DoLog(LOG_TYPE_HOLD, sid, fmt.Sprintf("%v released (reason: %v)", vid, reason))
+	outResult(nil)
+}
+
+// opHolds does the holds function. It lists all active holds,
+// optionally only the ones of one service provider.
+func opHolds(request map[string]interface{}) {
+	ctx := context.Background()
+	sid := GetInt(request["sid"], 0)
+
+	sql := `SELECT VID, PROVIDERID, REASON, UNTIL, CREATIONDATE FROM holds
+			WHERE UNTIL > NOW() AND ($1 = 0 OR PROVIDERID = $1)
+			ORDER BY CREATIONDATE`
+	rows, err := DB.Query(ctx, sql, sid)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
+	}
+	defer rows.Close()
+
+	results := make([]interface{}, 0)
+	for rows.Next() {
+		var vid pgtype.Varchar
+		var pid pgtype.Int2
+		var reason pgtype.Varchar
+		var until pgtype.Timestamptz
+		var created pgtype.Timestamptz
+		err = rows.Scan(&vid, &pid, &reason, &until, &created)
+		if err != nil {
+			LogInternalf("Unexpected error while processing result (opHolds). Error: %v", err)
+			continue
+		}
+		dLine := make(map[string]interface{})
+		dLine["vid"] = vid.String
+		dLine["sid"] = pid.Int
+		dLine["reason"] = reason.String
+		dLine["until"] = FormatDateTime(until.Time.UTC())
+		dLine["created"] = FormatDateTime(created.Time.UTC())
+		results = append(results, dLine)
+	}
+	outResult(results)
+}
@@ -0,0 +1,144 @@
+package main
+
+/*
+This file contains the handling of idempotency keys. Clients may
+send an "idempotencykey" with add, publish and addbatch calls. If the
+same key is sent again within the configured time window (see
+idempotencyHours in config.json), the original result is returned
+instead of storing the payload again.
+
+The keys are stored in the database table "idempotency". This way,
+they work across all nodes of a cluster. A key is reserved before the
+operation starts (empty RESULT) and gets the result after success.
+Expired keys are deleted by the cleanup (see cleanupIdempotencyKeys).
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// getIdempotencyWindow returns the time window for idempotency keys
+func getIdempotencyWindow() time.Duration {
+	hours := cfg.IdempotencyHours
+	if hours < 1 {
+		hours = CNF_IDEMPOTENCY_HOURS // default
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// reserveIdempotencyKey reserves the given key for the given operation.
+// It returns true if the request must not be processed. In this case,
+// the original result or some error was already sent and the returned
+// error is the one from sending.
+// If it returns false, the caller has to process the request and call
+// storeIdempotencyResult on success. Call releaseIdempotencyKey in any
+// case (eg using defer) to free the key if the operation failed.
+func reserveIdempotencyKey(c echo.Context, sid int, op string, key string) (bool, error) {
+	ctx := c.Request().Context()
+	if !ValidateIdempotencyKey(key) {
+		return true, generateError(c, DV_INVALID_ENCODING, "Invalid idempotency key")
+	}
+
+	sql := `INSERT INTO idempotency (PROVIDERID, IKEY, OP, RESULT, CREATIONDATE)
+			VALUES ($1, $2, $3, '', NOW()) ON CONFLICT DO NOTHING`
+	ctag, err := DB.Exec(ctx, sql, sid, key, op)
+	if err != nil {
+		LogInternalf("Failed to reserve idempotency key with SQL: [%v] Error: %v", sql, err)
+		return true, generateDBError(c, err,
+			"Failed to store idempotency key. Contact our support.")
+	}
+	if ctag.RowsAffected() == 1 {
+		return false, nil // reserved
+	}
+
+	// The key is already known
+	var knownOp string
+	var result string
+	var created time.Time
+	sql = "SELECT OP, RESULT, CREATIONDATE FROM idempotency WHERE PROVIDERID=$1 AND IKEY=$2"
+	err = DB.QueryRow(ctx, sql, sid, key).Scan(&knownOp, &result, &created)
+	if err == pgx.ErrNoRows {
+		// deleted in the meantime (expired), try again
+		return reserveIdempotencyKey(c, sid, op, key)
+	}
+	if err != nil {
+		LogInternalf("Failed to query idempotency key with SQL: [%v] Error: %v", sql, err)
+		return true, generateDBError(c, err,
+			"Failed to query idempotency key. Contact our support.")
+	}
+
+	if time.Since(created) > getIdempotencyWindow() {
+		// Expired but not cleaned up yet. Take it over, but only if no
+		// other request was faster.
+		sql = `UPDATE idempotency SET OP=$3, RESULT='', CREATIONDATE=NOW()
+				WHERE PROVIDERID=$1 AND IKEY=$2 AND CREATIONDATE=$4`
+		ctag, err = DB.Exec(ctx, sql, sid, key, op, created)
+		if err != nil {
+			LogInternalf("Failed to renew idempotency key with SQL: [%v] Error: %v", sql, err)
+			return true, generateDBError(c, err,
+				"Failed to store idempotency key. Contact our support.")
+		}
+		if ctag.RowsAffected() == 1 {
+			return false, nil // reserved
+		}
+		return true, generateError(c, DV_IDEMPOTENCY_KEY_USED,
+			"Some request with this idempotency key is still in progress")
+	}
+	if knownOp != op {
+		return true, generateError(c, DV_IDEMPOTENCY_KEY_USED,
+			"This idempotency key was used for another operation")
+	}
+	if result == "" {
+		return true, generateError(c, DV_IDEMPOTENCY_KEY_USED,
+			"Some request with this idempotency key is still in progress")
+	}
+
+	// Return the original result
+	var rResult map[string]interface{}
+	if err = json.Unmarshal([]byte(result), &rResult); err != nil {
+		LogInternalf("Invalid idempotency result for sid %v and key %v: %v", sid, key, err)
+		return true, generateError(c, DV_INTERNAL_ERROR,
+			"Failed to read original result. Contact our support.")
+	}
+	return true, generateResult(c, rResult)
+}
+
+// storeIdempotencyResult stores the result of a successful operation
+// for the given key. It does not use the request context, because the
+// result must get stored even if the client went away meanwhile.
+func storeIdempotencyResult(sid int, key string, rResult map[string]interface{}) {
+	j, err := json.Marshal(rResult)
+	if err != nil {
+		panic("Error during JSON generation in storeIdempotencyResult.")
+	}
+	sql := "UPDATE idempotency SET RESULT=$3 WHERE PROVIDERID=$1 AND IKEY=$2"
+	_, err = DB.Exec(context.Background(), sql, sid, key, string(j))
+	if err != nil {
+		LogInternalf("Failed to store idempotency result with SQL: [%v] Error: %v", sql, err)
+	}
+}
+
+// releaseIdempotencyKey frees the given key if there is no result
+// stored (the operation failed). Otherwise, it does nothing.
+func releaseIdempotencyKey(sid int, key string) {
+	sql := "DELETE FROM idempotency WHERE PROVIDERID=$1 AND IKEY=$2 AND RESULT=''"
+	_, err := DB.Exec(context.Background(), sql, sid, key)
+	if err != nil {
+		LogInternalf("Failed to release idempotency key with SQL: [%v] Error: %v", sql, err)
+	}
+}
+
+// cleanupIdempotencyKeys deletes all expired idempotency keys.
+// It is called by cleanupHeartBeat.
+func cleanupIdempotencyKeys(ctx context.Context) {
+	sql := `DELETE FROM idempotency WHERE CREATIONDATE < NOW() - $1 * INTERVAL '1 hour'`
+	_, err := DB.Exec(ctx, sql, int(getIdempotencyWindow().Hours()))
+	if err != nil {
+		LogInternalf("Failed to delete expired idempotency keys (cleanupHeartBeat): %v", err)
+	}
+}
@@ -6,8 +6,18 @@ CREATE TABLE IF NOT EXISTS data (
   PAYLOAD BYTES NOT NULL,
   PROVIDERID SMALLINT NOT NULL,
   CREATIONDATE TIMESTAMPTZ NOT NULL,
+  UPDATEDATE TIMESTAMPTZ NULL,
   DURATION SMALLINT NOT NULL DEFAULT 0,
-  PRIMARY KEY (VID)
+  REVISION INT NOT NULL DEFAULT 1,
+  EXPIRES TIMESTAMPTZ NULL,
+  DELETED TIMESTAMPTZ NULL,
+  REVOKED TIMESTAMPTZ NULL,
+  MAXREADS INT NOT NULL DEFAULT 0,
+  READS INT NOT NULL DEFAULT 0,
+  READERS INT[] NULL,
+  PRIMARY KEY (VID),
+  INDEX (EXPIRES),
+  INDEX (DELETED)
 );
 
 CREATE TABLE IF NOT EXISTS provider (
@@ -17,16 +27,54 @@ CREATE TABLE IF NOT EXISTS provider (
   PASSWORD STRING NOT NULL,
   IP STRING NOT NULL DEFAULT '',
   CREATIONDATE TIMESTAMPTZ NOT NULL,
+  HISTORY SMALLINT NOT NULL DEFAULT 0,
+  DELETEGRACEDAYS SMALLINT NOT NULL DEFAULT 0,
+  WEBHOOK STRING NOT NULL DEFAULT '',
+  MAXSTALENESS SMALLINT NOT NULL DEFAULT 0,
+  REGION STRING NOT NULL DEFAULT '',
   PRIMARY KEY (PROVIDERID)
 );
 
 CREATE TABLE IF NOT EXISTS search (
   VID BYTES NOT NULL,
   WORD STRING NOT NULL,
+  FIELD STRING NOT NULL DEFAULT '',
   INDEX (WORD),
+  INDEX (FIELD, WORD),
   INDEX (VID)
 );
 
+CREATE TABLE IF NOT EXISTS history (
+  VID BYTES NOT NULL,
+  REVISION INT NOT NULL,
+  PAYLOAD BYTES NOT NULL,
+  WORDS STRING[] NOT NULL,
+  ARCHIVEDATE TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (VID, REVISION)
+);
+
+CREATE TABLE IF NOT EXISTS holds (
+  VID BYTES NOT NULL,
+  PROVIDERID SMALLINT NOT NULL,
+  REASON STRING NOT NULL,
+  UNTIL TIMESTAMPTZ NOT NULL,
+  CREATIONDATE TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (VID),
+  INDEX (PROVIDERID)
+);
+
+CREATE TABLE IF NOT EXISTS publishaccess (
+  ID SERIAL,
+  VID BYTES NOT NULL,
+  PROVIDERID SMALLINT NOT NULL,
+  READERID SMALLINT NOT NULL,
+  IP STRING NOT NULL DEFAULT '',
+  ACCESSDATE TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (ID),
+  INDEX (VID, PROVIDERID),
+  INDEX (ACCESSDATE)
+);
+
 CREATE TABLE IF NOT EXISTS audit (
   ID SERIAL,
   LOGTYPE INT NOT NULL,
@@ -42,6 +90,16 @@ CREATE TABLE IF NOT EXISTS nodes (
   PRIMARY KEY (NODEID)
 );
 
+CREATE TABLE IF NOT EXISTS idempotency (
+  PROVIDERID SMALLINT NOT NULL,
+  IKEY STRING NOT NULL,
+  OP STRING NOT NULL,
+  RESULT STRING NOT NULL DEFAULT '',
+  CREATIONDATE TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (PROVIDERID, IKEY),
+  INDEX (CREATIONDATE)
+);
+
 INSERT INTO provider (providerid, name, password, ip, creationdate) 
   VALUES(1, 'test', 'vaccinator', '127.0.0.1', now())
 ON CONFLICT DO NOTHING;
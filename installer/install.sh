@@ -74,6 +74,27 @@ then
     then
         echo "Stopping vaccinator.service..."
         systemctl stop vaccinator.service
+        echo -n "What IP is the database listening to (127.0.0.1): "
+        read dbip
+        if [ -z "$dbip" ]
+        then
+            dbip="127.0.0.1"
+        fi
+        echo -n "What is the database user name to use (dv): "
+        read dvuser
+        if [ -z "$dvuser" ]
+        then
+            dvuser="dv"
+        fi
+        echo "Update database tables... "
+        if sed -e"s|<USER>|$dvuser|g" "./upgrade.sql" | cockroach sql --host $dbip --insecure
+        then
+            echo "SQL script OK"
+        else
+            echo "SQL script FAILED"
+            echo "Stop because the database tables could not be updated!"
+            exit 1
+        fi
         echo -n "Copy vaccinator executable to $dvpath... "
         if install -o vaccinator -g vaccinator -m +x "./vaccinator" "$dvpath/"
         then
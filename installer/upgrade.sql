@@ -0,0 +1,69 @@
+-- Upgrade of existing installations (see install.sh). It only changes
+-- the schema and grants access to new tables. Service providers and
+-- other privileges are never touched. New installations get everything
+-- from database.sql, so add schema changes to both files.
+USE vaccinator;
+
+-- Tables added later
+CREATE TABLE IF NOT EXISTS history (
+  VID BYTES NOT NULL,
+  REVISION INT NOT NULL,
+  PAYLOAD BYTES NOT NULL,
+  WORDS STRING[] NOT NULL,
+  ARCHIVEDATE TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (VID, REVISION)
+);
+
+CREATE TABLE IF NOT EXISTS holds (
+  VID BYTES NOT NULL,
+  PROVIDERID SMALLINT NOT NULL,
+  REASON STRING NOT NULL,
+  UNTIL TIMESTAMPTZ NOT NULL,
+  CREATIONDATE TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (VID),
+  INDEX (PROVIDERID)
+);
+
+CREATE TABLE IF NOT EXISTS publishaccess (
+  ID SERIAL,
+  VID BYTES NOT NULL,
+  PROVIDERID SMALLINT NOT NULL,
+  READERID SMALLINT NOT NULL,
+  IP STRING NOT NULL DEFAULT '',
+  ACCESSDATE TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (ID),
+  INDEX (VID, PROVIDERID),
+  INDEX (ACCESSDATE)
+);
+
+CREATE TABLE IF NOT EXISTS idempotency (
+  PROVIDERID SMALLINT NOT NULL,
+  IKEY STRING NOT NULL,
+  OP STRING NOT NULL,
+  RESULT STRING NOT NULL DEFAULT '',
+  CREATIONDATE TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (PROVIDERID, IKEY),
+  INDEX (CREATIONDATE)
+);
+
+-- Columns and indexes added later
+ALTER TABLE data ADD COLUMN IF NOT EXISTS REVISION INT NOT NULL DEFAULT 1;
+ALTER TABLE provider ADD COLUMN IF NOT EXISTS HISTORY SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE data ADD COLUMN IF NOT EXISTS EXPIRES TIMESTAMPTZ NULL;
+CREATE INDEX IF NOT EXISTS data_expires_idx ON data (EXPIRES);
+ALTER TABLE data ADD COLUMN IF NOT EXISTS DELETED TIMESTAMPTZ NULL;
+CREATE INDEX IF NOT EXISTS data_deleted_idx ON data (DELETED);
+ALTER TABLE data ADD COLUMN IF NOT EXISTS REVOKED TIMESTAMPTZ NULL;
+ALTER TABLE data ADD COLUMN IF NOT EXISTS MAXREADS INT NOT NULL DEFAULT 0;
+ALTER TABLE data ADD COLUMN IF NOT EXISTS READS INT NOT NULL DEFAULT 0;
+ALTER TABLE data ADD COLUMN IF NOT EXISTS READERS INT[] NULL;
+ALTER TABLE data ADD COLUMN IF NOT EXISTS UPDATEDATE TIMESTAMPTZ NULL;
+ALTER TABLE provider ADD COLUMN IF NOT EXISTS DELETEGRACEDAYS SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE provider ADD COLUMN IF NOT EXISTS WEBHOOK STRING NOT NULL DEFAULT '';
+ALTER TABLE provider ADD COLUMN IF NOT EXISTS MAXSTALENESS SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE provider ADD COLUMN IF NOT EXISTS REGION STRING NOT NULL DEFAULT '';
+ALTER TABLE search ADD COLUMN IF NOT EXISTS FIELD STRING NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS search_field_word_idx ON search (FIELD, WORD);
+
+-- The vault user needs access to the tables added later
+GRANT ALL ON TABLE history, holds, publishaccess, idempotency TO <USER>;
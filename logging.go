@@ -1,20 +1,28 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgconn"
 )
 
 const (
-	LOG_TYPE_ADD     = 0
-	LOG_TYPE_GET     = 1
-	LOG_TYPE_UPDATE  = 2
-	LOG_TYPE_DELETE  = 3
-	LOG_TYPE_PUBLISH = 4
-	LOG_TYPE_ERROR   = 9
-	LOG_TYPE_NOTICE  = 10
+	LOG_TYPE_ADD      = 0
+	LOG_TYPE_GET      = 1
+	LOG_TYPE_UPDATE   = 2
+	LOG_TYPE_DELETE   = 3
+	LOG_TYPE_PUBLISH  = 4
+	LOG_TYPE_ERROR    = 9
+	LOG_TYPE_NOTICE   = 10
+	LOG_TYPE_BACKUP   = 11
+	LOG_TYPE_RESTORE  = 12
+	LOG_TYPE_EXPIRE   = 13
+	LOG_TYPE_UNDELETE = 14
+	LOG_TYPE_PURGE    = 15
+	LOG_TYPE_HOLD     = 16
+	LOG_TYPE_REGION   = 17
 )
 
 // DoLog creates an entry in the audit table.
@@ -30,10 +38,12 @@ func DoLog(logType int, provId int, message string) {
 	sql := `INSERT INTO audit (LOGTYPE, LOGDATE, PROVIDERID, LOGCOMMENT)
               VALUES($1, NOW(), $2, $3)`
 
-	_, err := DB.Exec(sql, logType, provId, message)
+	_, err := DB.Exec(context.Background(), sql, logType, provId, message)
 	if err != nil {
-		var pge pgx.PgError
-		errors.As(err, &pge) // need to cast to get error codes
+		var pge *pgconn.PgError
+		if !errors.As(err, &pge) { // need to cast to get error codes
+			pge = &pgconn.PgError{Message: err.Error()}
+		}
 		fmt.Printf("WARNING: Failed to insert to log table!\nError: '%v' (%v)\n",
 			pge.Message, pge.Code)
 	}
@@ -17,6 +17,7 @@ package main
 +--------------------------------------------------------*/
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -64,13 +65,11 @@ func main() {
 	fmt.Println("Starting DataVaccinator Vault server V" + SERVER_VERSION)
 
 	if cfg.DebugMode > 0 {
-		fmt.Printf("Cockroach DB (%v) connected (maxConnections: %v)\n", DBHost, DB.Stat().MaxConnections)
+		fmt.Printf("Cockroach DB (%v) connected (maxConnections: %v)\n", DBHost, DB.Config().MaxConns)
 	}
 
 	go cleanupHeartBeat() // start background task for DB cleanup
 
-	go keepAliveHeartBeat() // keep DB connection healthy
-
 	// handle OS signals
 	globalSigChan = make(chan os.Signal, 1)
 	signal.Notify(globalSigChan, os.Interrupt, syscall.SIGTERM)
@@ -160,7 +159,7 @@ func main() {
 		// TODO: Maybe check other values with relevance for the end user
 
 		// Check database availability
-		_, err := DB.Exec(";")
+		err := DB.Ping(c.Request().Context())
 		if err != nil {
 			return c.String(http.StatusServiceUnavailable, "Service Unavailable")
 		}
@@ -168,6 +167,11 @@ func main() {
 		return c.String(http.StatusOK, "OK")
 	})
 
+	// metrics (only for the configured IPs)
+	if cfg.MetricsIPs != "" {
+		e.GET("/metrics", metricsHandler)
+	}
+
 	// satisfy another webbrowser thing
 	e.GET("/favicon.ico", func(c echo.Context) error {
 		return c.String(http.StatusGone, "")
@@ -194,6 +198,13 @@ func main() {
 		}
 	}
 
+	// Timeouts against slow or stalled clients. The write timeout also
+	// limits the time for handling the request, so it has to be larger
+	// than all request deadlines (see checkTimeouts).
+	readTimeout := getTimeout(cfg.ReadTimeout, CNF_READ_TIMEOUT_SEC)
+	writeTimeout := getTimeout(cfg.WriteTimeout, CNF_WRITE_TIMEOUT_SEC)
+	idleTimeout := getTimeout(cfg.IdleTimeout, CNF_IDLE_TIMEOUT_SEC)
+
 	// create the web listeners
 	servers = make([]http.Server, len(listenTo))
 	for i := 0; i < len(listenTo); i++ {
@@ -204,9 +215,12 @@ func main() {
 			// test at https://www.ssllabs.com/ssltest/ (07/2021)
 
 			servers[i] = http.Server{
-				Addr:     serverAddress,
-				Handler:  e,                                       // set Echo as handler
-				ErrorLog: log.New(new(filterLogger), "echo: ", 0), // use our own filtered log
+				Addr:         serverAddress,
+				Handler:      e,                                       // set Echo as handler
+				ErrorLog:     log.New(new(filterLogger), "echo: ", 0), // use our own filtered log
+				ReadTimeout:  readTimeout,
+				WriteTimeout: writeTimeout,
+				IdleTimeout:  idleTimeout,
 				TLSConfig: &tls.Config{
 					GetCertificate: autoTLSManager.GetCertificate,
 					NextProtos:     []string{acme.ALPNProto},
@@ -227,9 +241,12 @@ func main() {
 			go listenWrapperTLS(&servers[i])
 		} else {
 			servers[i] = http.Server{
-				Addr:     serverAddress,
-				Handler:  e,                                       // set Echo as handler
-				ErrorLog: log.New(new(filterLogger), "echo: ", 0), // use our own filtered log
+				Addr:         serverAddress,
+				Handler:      e,                                       // set Echo as handler
+				ErrorLog:     log.New(new(filterLogger), "echo: ", 0), // use our own filtered log
+				ReadTimeout:  readTimeout,
+				WriteTimeout: writeTimeout,
+				IdleTimeout:  idleTimeout,
 			}
 			fmt.Println("⇨ http server started on " + serverAddress)
 			go listenWrapper(&servers[i])
@@ -293,6 +310,12 @@ func protocolHandler(c echo.Context) error {
 		fmt.Printf("%v REQUEST: %v\n", c.RealIP(), clientRequest)
 	}
 
+	// All queries of this request get cancelled after the deadline and
+	// get the statement timeout (see setStatementTimeout)
+	ctx, cancel := context.WithTimeout(withAPIRequest(c.Request().Context()), getOpTimeout(op))
+	defer cancel()
+	c.SetRequest(c.Request().WithContext(ctx))
+
 	// check login credentials
 	err = checkCredentials(c, clientRequest)
 	if err != nil {
@@ -307,14 +330,36 @@ func protocolHandler(c echo.Context) error {
 		return doAdd(c, clientRequest, false)
 	case "publish":
 		return doAdd(c, clientRequest, true)
+	case "addbatch":
+		return doAddBatch(c, clientRequest)
 	case "delete":
 		return doDelete(c, clientRequest)
+	case "undelete":
+		return doUndelete(c, clientRequest)
 	case "update":
 		return doUpdate(c, clientRequest)
+	case "updatebatch":
+		return doUpdateBatch(c, clientRequest)
+	case "addwords":
+		return doChangeWords(c, clientRequest, false)
+	case "removewords":
+		return doChangeWords(c, clientRequest, true)
 	case "get":
 		return doGet(c, clientRequest, false)
 	case "getpublished":
 		return doGet(c, clientRequest, true)
+	case "republish":
+		return doRepublish(c, clientRequest)
+	case "revoke":
+		return doRevoke(c, clientRequest)
+	case "publishaccess":
+		return doPublishAccess(c, clientRequest)
+	case "history":
+		return doHistory(c, clientRequest)
+	case "getversion":
+		return doGetVersion(c, clientRequest)
+	case "revert":
+		return doRevert(c, clientRequest)
 	case "search":
 		return doSearch(c, clientRequest)
 	}
@@ -341,11 +386,13 @@ func checkCredentials(c echo.Context, clientRequest map[string]interface{}) erro
 	clientIP := c.RealIP()
 	var pwd string = ""
 	var allowedIP string = ""
-	sql := "SELECT password,ip FROM provider WHERE providerid=$1"
-	DB.QueryRow(sql, sid).Scan(&pwd, &allowedIP)
+	var maxStaleness int
+	sql := "SELECT password,ip,maxstaleness FROM provider WHERE providerid=$1"
+	DB.QueryRow(c.Request().Context(), sql, sid).Scan(&pwd, &allowedIP, &maxStaleness)
 	if pwd != spwd {
 		return errors.New("Invalid credentials")
 	}
+	c.Set("maxstaleness", maxStaleness) // see getMaxStaleness
 	if cfg.DisableIPCheck == 0 && !strings.Contains(allowedIP, clientIP) {
 		go DoLog(LOG_TYPE_ERROR, sid, "Not allowed IP client address "+clientIP)
 		return errors.New("Not allowed IP client address")
@@ -373,6 +420,13 @@ func generateResult(c echo.Context, resultMap map[string]interface{}) error {
 // the receiver some hint about the problem.
 func generateError(c echo.Context, errorCode int, errorDesc string) error {
 
+	// Internal errors after the deadline of the request are timeouts
+	if errorCode == DV_INTERNAL_ERROR &&
+		c.Request().Context().Err() == context.DeadlineExceeded {
+		errorCode = DV_TIMEOUT
+		errorDesc = "The operation took too long. Please try again."
+	}
+
 	// Determine which error type this code is (simplified version)
 	status := "INVALID"
 	httpType := http.StatusOK
@@ -380,6 +434,10 @@ func generateError(c echo.Context, errorCode int, errorDesc string) error {
 		status = "ERROR"
 		httpType = http.StatusInternalServerError
 	}
+	if errorCode == DV_TIMEOUT {
+		status = "ERROR"
+		httpType = http.StatusServiceUnavailable
+	}
 
 	type errorStruct struct {
 		Status  string `json:"status"`
@@ -404,6 +462,27 @@ func generateError(c echo.Context, errorCode int, errorDesc string) error {
 	return c.String(httpType, string(jRequest))
 }
 
+// generateDBError returns the error response for the given database
+// error (see getDBErrorDetails).
+func generateDBError(c echo.Context, err error, errorDesc string) error {
+	code, desc := getDBErrorDetails(err, errorDesc)
+	return generateError(c, code, desc)
+}
+
+// generateItemError creates a DataVaccinator style error for a single
+// item of some batch operation. Use error codes from DV_x constants.
+func generateItemError(errorCode int, errorDesc string) map[string]interface{} {
+	status := "INVALID"
+	if errorCode == DV_INTERNAL_ERROR || errorCode == DV_TIMEOUT {
+		status = "ERROR"
+	}
+	iResult := make(map[string]interface{})
+	iResult["status"] = status
+	iResult["code"] = errorCode
+	iResult["desc"] = errorDesc
+	return iResult
+}
+
 // degradePrivileges waits until ListenerAddr is set and then
 // tries to degrade the user of this process to the given user.
 // NOTE: The 5 seconds fallback is needed because we found no
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"strings"
+	"time"
 
-	"github.com/jackc/pgx"
-	"github.com/jackc/pgx/pgtype"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
 )
 
 var flagPretty bool
 var flagData string
+var flagBackup string
+var flagRestore string
+var flagKeyFile string
+var flagAsOf string
+var flagDryRun bool
 
 // isManagement handles any commandline parameters. If a valid one
 // is given, it will return false to make the main() function exit
@@ -23,8 +31,22 @@ func isManagement() bool {
 	// the default value, and the third is the description of the flag.
 	flag.BoolVar(&flagPretty, "p", false, "Pretty print JSON results")
 	flag.StringVar(&flagData, "j", "", "JSON operation instructions like j='{\"op\":\"list\"}'")
+	flag.StringVar(&flagBackup, "backup", "", "Create a backup of all vault tables in the given file")
+	flag.StringVar(&flagRestore, "restore", "", "Restore all vault tables from the given backup file")
+	flag.StringVar(&flagKeyFile, "keyfile", "", "File containing the operator key for backup encryption")
+	flag.StringVar(&flagAsOf, "asof", "", "Backup some past point in time (eg \"-1h\", CockroachDB only)")
+	flag.BoolVar(&flagDryRun, "dryrun", false, "Only verify the backup file (restore)")
 	flag.Parse()
 
+	if flagBackup != "" {
+		opBackup(flagBackup, flagKeyFile, flagAsOf)
+		return true
+	}
+	if flagRestore != "" {
+		opRestore(flagRestore, flagKeyFile, flagDryRun)
+		return true
+	}
+
 	if flagData == "" {
 		return false
 	}
@@ -57,15 +79,41 @@ func isManagement() bool {
 		opRemove(request)
 		return true
 	}
+	if op == "undelete" {
+		opUndelete(request)
+		return true
+	}
+	if op == "hold" {
+		opHold(request)
+		return true
+	}
+	if op == "release" {
+		opRelease(request)
+		return true
+	}
+	if op == "holds" {
+		opHolds(request)
+		return true
+	}
+	if op == "checksearch" {
+		opCheckSearch(request)
+		return true
+	}
+	if op == "setregion" {
+		opSetRegion(request)
+		return true
+	}
 	outError("Unknown or missing op parameter")
 	return true
 }
 
 // opList does the list function
 func opList() {
-	sql := `SELECT providerid, name, description, ip, creationdate 
+	ctx := context.Background()
+	sql := `SELECT providerid, name, description, ip, creationdate, history, deletegracedays, webhook,
+				maxstaleness, region
 			FROM provider ORDER BY providerid`
-	rows, err := DB.Query(sql)
+	rows, err := DB.Query(ctx, sql)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
 	}
@@ -78,7 +126,13 @@ func opList() {
 		var description pgtype.Varchar
 		var ip pgtype.Varchar
 		var creationdate pgtype.Timestamptz
-		err = rows.Scan(&sid, &name, &description, &ip, &creationdate)
+		var history pgtype.Int2
+		var graceDays pgtype.Int2
+		var webhook pgtype.Varchar
+		var maxStaleness pgtype.Int2
+		var region pgtype.Varchar
+		err = rows.Scan(&sid, &name, &description, &ip, &creationdate, &history, &graceDays, &webhook,
+			&maxStaleness, &region)
 		if err != nil {
 			LogInternalf("Unexpected error while processing result (opList). Error: %v", err)
 			continue
@@ -89,6 +143,11 @@ func opList() {
 		dLine["desc"] = description.String
 		dLine["ip"] = ip.String
 		dLine["created"] = creationdate.Time
+		dLine["history"] = history.Int
+		dLine["gracedays"] = graceDays.Int
+		dLine["webhook"] = webhook.String
+		dLine["maxstaleness"] = maxStaleness.Int
+		dLine["region"] = region.String
 		results = append(results, dLine)
 	}
 	outResult(results)
@@ -96,11 +155,16 @@ func opList() {
 
 // opAdd does the add function
 func opAdd(request map[string]interface{}) {
+	ctx := context.Background()
 	sid := GetInt(request["sid"], 0)
 	name := GetString(request["name"], "")
 	desc := GetString(request["desc"], "")
 	pass := GetString(request["password"], "")
 	ip := GetString(request["ip"], "")
+	history := GetInt(request["history"], 0)
+	graceDays := GetInt(request["gracedays"], 0)
+	webhook := GetString(request["webhook"], "")
+	maxStaleness := GetInt(request["maxstaleness"], 0)
 
 	if name == "" || pass == "" || ip == "" {
 		outError("Missing mandatory parameter (check name, pass, ip")
@@ -110,18 +174,33 @@ func opAdd(request map[string]interface{}) {
 		outError("Invalid sid parameter")
 		return
 	}
+	if history < 0 || history > CNF_MAX_HISTORY_VERSIONS {
+		outError(fmt.Sprintf("Invalid history parameter (0 to %d)", CNF_MAX_HISTORY_VERSIONS))
+		return
+	}
+	if graceDays < 0 || graceDays > CNF_MAX_DELETE_GRACE_DAYS {
+		outError(fmt.Sprintf("Invalid gracedays parameter (0 to %d)", CNF_MAX_DELETE_GRACE_DAYS))
+		return
+	}
+	if !ValidateWebhook(webhook) {
+		outError("Invalid webhook parameter (use some http:// or https:// URL)")
+		return
+	}
+	if maxStaleness < 0 || maxStaleness > CNF_MAX_STALENESS_SEC {
+		outError(fmt.Sprintf("Invalid maxstaleness parameter (0 to %d)", CNF_MAX_STALENESS_SEC))
+		return
+	}
 
-	sql := "INSERT INTO provider (PROVIDERID, NAME, DESCRIPTION, PASSWORD, IP, CREATIONDATE) " +
-		"VALUES ($1, $2, $3, $4, $5, NOW())"
-	_, err := DB.Exec(sql, sid, name, desc, pass, ip)
+	sql := "INSERT INTO provider (PROVIDERID, NAME, DESCRIPTION, PASSWORD, IP, CREATIONDATE, " +
+		"HISTORY, DELETEGRACEDAYS, WEBHOOK, MAXSTALENESS) " +
+		"VALUES ($1, $2, $3, $4, $5, NOW(), $6, $7, $8, $9)"
+	_, err := DB.Exec(ctx, sql, sid, name, desc, pass, ip, history, graceDays, webhook, maxStaleness)
 	if err != nil {
-		var pge pgx.PgError
-		errors.As(err, &pge) // need to cast to get error codes
-		if pge.Code == "23505" {
+		if getPgErrorCode(err) == "23505" {
 			outError("The sid you provided is allready in use!")
 			return
 		}
-		LogInternalf("Failed to store new provider with SQL: [%v] Error: %v", sql, pge)
+		LogInternalf("Failed to store new provider with SQL: [%v] Error: %v", sql, err)
 		outError("Failed to insert provider. Check your values!")
 		return
 	}
@@ -130,16 +209,37 @@ func opAdd(request map[string]interface{}) {
 
 // opUpdate does the add function
 func opUpdate(request map[string]interface{}) {
+	ctx := context.Background()
 	sid := GetInt(request["sid"], 0)
 	name := GetString(request["name"], "--UNSET--")
 	desc := GetString(request["desc"], "--UNSET--")
 	pass := GetString(request["password"], "--UNSET--")
 	ip := GetString(request["ip"], "--UNSET--")
+	history := GetInt(request["history"], -1)
+	graceDays := GetInt(request["gracedays"], -1)
+	webhook := GetString(request["webhook"], "--UNSET--")
+	maxStaleness := GetInt(request["maxstaleness"], -1)
 
 	if sid < 1 {
 		outError("Invalid sid parameter")
 		return
 	}
+	if history > CNF_MAX_HISTORY_VERSIONS {
+		outError(fmt.Sprintf("Invalid history parameter (0 to %d)", CNF_MAX_HISTORY_VERSIONS))
+		return
+	}
+	if graceDays > CNF_MAX_DELETE_GRACE_DAYS {
+		outError(fmt.Sprintf("Invalid gracedays parameter (0 to %d)", CNF_MAX_DELETE_GRACE_DAYS))
+		return
+	}
+	if webhook != "--UNSET--" && !ValidateWebhook(webhook) {
+		outError("Invalid webhook parameter (use some http:// or https:// URL)")
+		return
+	}
+	if maxStaleness > CNF_MAX_STALENESS_SEC {
+		outError(fmt.Sprintf("Invalid maxstaleness parameter (0 to %d)", CNF_MAX_STALENESS_SEC))
+		return
+	}
 
 	type sqlExec struct {
 		sql   string
@@ -164,13 +264,27 @@ func opUpdate(request map[string]interface{}) {
 		var t = sqlExec{"UPDATE provider SET IP=$2 WHERE PROVIDERID=$1", ip}
 		sqlList = append(sqlList, t)
 	}
+	if history >= 0 {
+		var t = sqlExec{"UPDATE provider SET HISTORY=$2 WHERE PROVIDERID=$1", history}
+		sqlList = append(sqlList, t)
+	}
+	if graceDays >= 0 {
+		var t = sqlExec{"UPDATE provider SET DELETEGRACEDAYS=$2 WHERE PROVIDERID=$1", graceDays}
+		sqlList = append(sqlList, t)
+	}
+	if webhook != "--UNSET--" {
+		var t = sqlExec{"UPDATE provider SET WEBHOOK=$2 WHERE PROVIDERID=$1", webhook}
+		sqlList = append(sqlList, t)
+	}
+	if maxStaleness >= 0 {
+		var t = sqlExec{"UPDATE provider SET MAXSTALENESS=$2 WHERE PROVIDERID=$1", maxStaleness}
+		sqlList = append(sqlList, t)
+	}
 
 	for _, command := range sqlList {
-		ctag, err := DB.Exec(command.sql, sid, command.value)
+		ctag, err := DB.Exec(ctx, command.sql, sid, command.value)
 		if err != nil {
-			var pge pgx.PgError
-			errors.As(err, &pge) // need to cast to get error codes
-			LogInternalf("Failed to store new provider with SQL: [%v] Error: %v", command.sql, pge)
+			LogInternalf("Failed to store new provider with SQL: [%v] Error: %v", command.sql, err)
 			outError("Failed to update provider. Check your values!")
 			return
 		}
@@ -185,6 +299,7 @@ func opUpdate(request map[string]interface{}) {
 
 // opRemove does the remove function
 func opRemove(request map[string]interface{}) {
+	ctx := context.Background()
 	sid := GetInt(request["sid"], 0)
 	force := GetBool(request["force"], false)
 	if sid < 1 {
@@ -192,6 +307,17 @@ func opRemove(request map[string]interface{}) {
 		return
 	}
 
+	// Entries on legal hold must not get deleted (checked again in the
+	// transaction below)
+	held, err := countHolds(ctx, DB, sid)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to query holds (remove). Error: %v", err))
+	}
+	if held > 0 {
+		outError(fmt.Sprintf("Service provider has %d VIDs on legal hold. Release them first.", held))
+		return
+	}
+
 	if !force {
 		fmt.Printf("Do you really want to delete all data of service provider %d?\n", sid)
 		conf := askForConfirmation("The deletion is final! Delete now?")
@@ -201,46 +327,118 @@ func opRemove(request map[string]interface{}) {
 		}
 	}
 
-	// start transaction
-	tx, err := DB.Begin()
+	// Delete search words, history, access log of published entries,
+	// VID entries and the service provider entry in one transaction
+	statements := []string{
+		`DELETE FROM search WHERE VID IN(
+			SELECT VID FROM data WHERE providerid = $1
+		)`,
+		`DELETE FROM history WHERE VID IN(
+			SELECT VID FROM data WHERE providerid = $1
+		)`,
+		`DELETE FROM publishaccess WHERE providerid = $1`,
+		`DELETE FROM data WHERE providerid = $1`,
+		`DELETE FROM provider WHERE providerid = $1`,
+	}
+	err = execTx(ctx, "remove", func(tx pgx.Tx) error {
+		held, err := countHolds(ctx, tx, sid)
+		if err != nil {
+			return err
+		}
+		if held > 0 {
+			return &dvError{DV_LEGAL_HOLD,
+				fmt.Sprintf("Service provider has %d VIDs on legal hold. Release them first.", held), nil}
+		}
+		for _, sql := range statements {
+			if _, err := tx.Exec(ctx, sql, sid); err != nil {
+				return fmt.Errorf("SQL: [%v] Error: %w", sql, err)
+			}
+		}
+		return nil
+	})
+	var dve *dvError
+	if errors.As(err, &dve) {
+		outError(dve.desc)
+		return
+	}
 	if err != nil {
-		panic(fmt.Sprintf("Failed to start transaction (remove). Error: %v", err))
+		panic(fmt.Sprintf("Failed to remove service provider (remove). %v", err))
 	}
 
-	// delete search words
-	sql := `DELETE FROM search WHERE VID IN(
-				SELECT VID FROM data WHERE providerid = $1
-			)`
-	_, err = tx.Exec(sql, sid)
-	if err != nil {
-		tx.Rollback()
-		panic(fmt.Sprintf("Failed to delete searchwords (remove) with SQL: [%v] Error: %v", sql, err))
+	outResult(nil)
+}
+
+// opUndelete does the undelete function. It restores deleted entries
+// of the provider which were not purged yet. Either the VIDs or some
+// date (since) has to be given.
+func opUndelete(request map[string]interface{}) {
+	ctx := context.Background()
+	sid := GetInt(request["sid"], 0)
+	vids := GetStringArray(request["vid"], []string{})
+	since := GetString(request["since"], "")
+	if sid < 1 {
+		outError("Invalid sid parameter")
+		return
+	}
+	if len(vids) == 0 {
+		vidList := GetString(request["vid"], "")
+		if vidList != "" {
+			vids = strings.SplitN(vidList, " ", -1)
+		}
+	}
+	if (len(vids) == 0) == (since == "") {
+		outError("Either vid or since parameter is needed")
+		return
 	}
 
-	// delete VID entries
-	sql = `DELETE FROM data WHERE providerid = $1`
-	_, err = tx.Exec(sql, sid)
+	sql := "UPDATE data SET DELETED=NULL WHERE PROVIDERID=$1 AND DELETED IS NOT NULL AND "
+	args := []interface{}{sid}
+	if since != "" {
+		t, err := time.Parse("2006-01-02 15:04:05", since)
+		if err != nil {
+			outError("Invalid since parameter (use YYYY-MM-DD HH:MM:SS)")
+			return
+		}
+		sql += "DELETED >= $2"
+		args = append(args, t)
+	} else {
+		for _, v := range vids {
+			if !ValidateVID(v) {
+				outError("Invalid VID " + v)
+				return
+			}
+		}
+		sql += "VID=ANY($2::BYTES[])"
+		args = append(args, VIDArray(vids))
+	}
+	rows, err := DB.Query(ctx, sql+" RETURNING VID", args...)
 	if err != nil {
-		tx.Rollback()
-		panic(fmt.Sprintf("Failed to delete payloads (remove) with SQL: [%v] Error: %v", sql, err))
+		panic(fmt.Sprintf("Failed to restore payloads (undelete) with SQL: [%v] Error: %v", sql, err))
 	}
+	defer rows.Close()
 
-	// delete service provider entry
-	sql = `DELETE FROM provider WHERE providerid = $1`
-	_, err = tx.Exec(sql, sid)
-	if err != nil {
-		tx.Rollback()
-		panic(fmt.Sprintf("Failed to delete sid entry (remove) with SQL: [%v] Error: %v", sql, err))
+	restored := []string{}
+	for rows.Next() {
+		var vid pgtype.Varchar
+		err = rows.Scan(&vid)
+		if err != nil {
+			LogInternalf("Unexpected error while processing result (opUndelete). Error: %v", err)
+			continue
+		}
+		restored = append(restored, vid.String)
+	}
+	if rows.Err() != nil {
+		panic(fmt.Sprintf("Failed to restore payloads (undelete). Error: %v", rows.Err()))
 	}
 
-	// commit transaction
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		panic(fmt.Sprintf("Failed to commit remove statements. Error: %v", err))
+	if len(restored) > 0 {
+		DoLog(LOG_TYPE_UNDELETE, sid, strings.Join(restored, " ")+" (commandline)")
 	}
 
-	outResult(nil)
+	dResult := make(map[string]interface{})
+	dResult["count"] = len(restored)
+	dResult["vids"] = restored
+	outResult(dResult)
 }
 
 // outResult outputs a result JSON after successful processing
@@ -0,0 +1,95 @@
+package main
+
+/*
+This file contains the metrics of the vault. They are available at
+GET /metrics in the Prometheus text format, but only for the IPs listed
+in metricsIPs (see config.json). Without, the endpoint is disabled.
+
+The counters start at zero with every start of the vault and are per
+node (not for the whole cluster).
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// txStats are the transaction counters of one operation
+type txStats struct {
+	count    uint64 // transactions
+	retries  uint64 // additional tries after serialization errors
+	failures uint64 // transactions which failed in the end
+}
+
+var txMetrics = make(map[string]*txStats)
+var txMetricsLock sync.Mutex
+
+// countTx counts one transaction of the given operation which needed
+// the given number of tries.
+func countTx(op string, tries int, err error) {
+	txMetricsLock.Lock()
+	defer txMetricsLock.Unlock()
+
+	stats, ok := txMetrics[op]
+	if !ok {
+		stats = &txStats{}
+		txMetrics[op] = stats
+	}
+	stats.count++
+	if tries > 1 {
+		stats.retries += uint64(tries - 1)
+	}
+	if err != nil {
+		stats.failures++
+	}
+}
+
+// isMetricsIP returns true if the given IP is allowed to get metrics
+func isMetricsIP(ip string) bool {
+	for _, allowed := range strings.Split(cfg.MetricsIPs, ",") {
+		if strings.TrimSpace(allowed) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsHandler implements the GET /metrics endpoint
+func metricsHandler(c echo.Context) error {
+	if !isMetricsIP(c.RealIP()) {
+		return c.String(http.StatusForbidden, "Forbidden")
+	}
+	return c.String(http.StatusOK, formatMetrics())
+}
+
+// formatMetrics returns all metrics in the Prometheus text format
+func formatMetrics() string {
+	txMetricsLock.Lock()
+	defer txMetricsLock.Unlock()
+
+	ops := make([]string, 0, len(txMetrics))
+	for op := range txMetrics {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var sb strings.Builder
+	write := func(name string, help string, value func(s *txStats) uint64) {
+		fmt.Fprintf(&sb, "# HELP %v %v\n# TYPE %v counter\n", name, help, name)
+		for _, op := range ops {
+			fmt.Fprintf(&sb, "%v{op=%q} %d\n", name, op, value(txMetrics[op]))
+		}
+	}
+	write("dv_tx_total", "Number of database transactions.",
+		func(s *txStats) uint64 { return s.count })
+	write("dv_tx_retries_total", "Number of transaction retries after serialization errors.",
+		func(s *txStats) uint64 { return s.retries })
+	write("dv_tx_failures_total", "Number of failed database transactions.",
+		func(s *txStats) uint64 { return s.failures })
+	return sb.String()
+}
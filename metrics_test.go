@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCountTx(t *testing.T) {
+	txMetrics = make(map[string]*txStats)
+	defer func() { txMetrics = make(map[string]*txStats) }()
+
+	countTx("add", 1, nil)
+	countTx("add", 3, nil)
+	countTx("add", 5, errors.New("failed"))
+	countTx("update", 1, nil)
+
+	tests := []struct {
+		op   string
+		want txStats
+	}{
+		{"add", txStats{count: 3, retries: 6, failures: 1}},
+		{"update", txStats{count: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.op, func(t *testing.T) {
+			if got := txMetrics[tt.op]; got == nil || *got != tt.want {
+				t.Errorf("countTx() stats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatMetrics(t *testing.T) {
+	txMetrics = map[string]*txStats{
+		"update": {count: 4, retries: 2, failures: 1},
+		"add":    {count: 7},
+	}
+	defer func() { txMetrics = make(map[string]*txStats) }()
+
+	want := "# HELP dv_tx_total Number of database transactions.\n" +
+		"# TYPE dv_tx_total counter\n" +
+		"dv_tx_total{op=\"add\"} 7\n" +
+		"dv_tx_total{op=\"update\"} 4\n" +
+		"# HELP dv_tx_retries_total Number of transaction retries after serialization errors.\n" +
+		"# TYPE dv_tx_retries_total counter\n" +
+		"dv_tx_retries_total{op=\"add\"} 0\n" +
+		"dv_tx_retries_total{op=\"update\"} 2\n" +
+		"# HELP dv_tx_failures_total Number of failed database transactions.\n" +
+		"# TYPE dv_tx_failures_total counter\n" +
+		"dv_tx_failures_total{op=\"add\"} 0\n" +
+		"dv_tx_failures_total{op=\"update\"} 1\n"
+	if got := formatMetrics(); got != want {
+		t.Errorf("formatMetrics() = %v, want %v", got, want)
+	}
+}
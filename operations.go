@@ -6,13 +6,15 @@ operations.
 */
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 
-	"github.com/jackc/pgx"
-	"github.com/jackc/pgx/pgtype"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
 )
 
@@ -39,11 +41,15 @@ func doCheck(c echo.Context, clientRequest map[string]interface{}) error {
 
 // doAdd implements the "add" api operation
 func doAdd(c echo.Context, clientRequest map[string]interface{}, isPublish bool) error {
+	ctx := c.Request().Context()
 	data := GetString(clientRequest["data"], "")
 	uid := GetString(clientRequest["uid"], "")
 	sid := GetInt(clientRequest["sid"], 0)
-	words := GetStringArray(clientRequest["words"], []string{})
+	words, wordsErr := getSearchWords(clientRequest)
 	duration := GetInt(clientRequest["duration"], 0)
+	ikey := GetString(clientRequest["idempotencykey"], "")
+	maxReads := GetInt(clientRequest["maxreads"], 0)
+	expires, err := getExpiry(clientRequest)
 
 	if data == "" || sid == 0 {
 		return generateError(c, DV_MISSING_PARAM, "Missing data")
@@ -55,52 +61,80 @@ func doAdd(c echo.Context, clientRequest map[string]interface{}, isPublish bool)
 	if isPublish && (duration < 1 || duration > CNF_MAX_PUBLISH_DAYS) {
 		return generateError(c, DV_INVALID_PARAMSIZE, "Invalid duration range")
 	}
+	if err != nil {
+		return generateError(c, DV_INVALID_PARAMSIZE, err.Error())
+	}
+	if isPublish && expires.Status == pgtype.Present {
+		return generateError(c, DV_INVALID_FOR_PUBLISHED,
+			"Published entries expire by duration")
+	}
+	readers, err := getReaders(clientRequest)
+	if err != nil {
+		return generateError(c, DV_INVALID_PARAMSIZE, err.Error())
+	}
+	if maxReads < 0 || maxReads > CNF_MAX_PUBLISH_READS {
+		return generateError(c, DV_INVALID_PARAMSIZE, "Invalid maxreads range")
+	}
+	if !isPublish && (maxReads > 0 || readers.Status == pgtype.Present) {
+		return generateError(c, DV_INVALID_PARAMSIZE,
+			"maxreads and readers are only allowed for published entries")
+	}
+	if wordsErr != nil {
+		return generateError(c, DV_INVALID_ENCODING, wordsErr.Error())
+	}
+	if err := checkSearchWordCount(len(MakeUnique(words))); err != nil {
+		return generateError(c, DV_INVALID_PARAMSIZE, err.Error())
+	}
 
-	var err error
+	op := "add"
+	if isPublish {
+		op = "publish"
+	}
+	if ikey != "" {
+		if done, err := reserveIdempotencyKey(c, sid, op, ikey); done {
+			return err // already processed
+		}
+		defer releaseIdempotencyKey(sid, ikey)
+	}
+
+	// Store the payload and its search words (only add, not publish)
+	// using one transaction.
 	var vid string
-	var sql string
 	for try := 0; try < 4; try++ {
 		vid = GenerateVID()
-		if !isPublish {
-			// ADD function
-			sql = "INSERT INTO data (VID, PAYLOAD, PROVIDERID, CREATIONDATE) " +
-				"VALUES ($1, $2, $3, NOW())"
-			_, err = DB.Exec(sql, vid, data, sid)
-		} else {
-			// PUBLISH function
-			sql = "INSERT INTO data (VID, PAYLOAD, PROVIDERID, CREATIONDATE, DURATION) " +
-				"VALUES ($1, $2, $3, NOW(), $4)"
-			_, err = DB.Exec(sql, vid, data, sid, duration)
-		}
-		if err != nil {
-			var pge pgx.PgError
-			errors.As(err, &pge) // need to cast to get error codes
-			if pge.Code == "23505" {
-				// Duplicate key error. This might happen every now and then.
-				// Therefore, retry up to 4 times.
-				continue
+		err = execTx(ctx, op, func(tx pgx.Tx) error {
+			var sql string
+			var err error
+			if !isPublish {
+				// ADD function
+				sql = "INSERT INTO data (VID, PAYLOAD, PROVIDERID, CREATIONDATE, EXPIRES" +
+					regionColumn() + ") VALUES ($1, $2, $3, NOW(), $4" +
+					regionValue(providerRegionSQL("$3")) + ")"
+				_, err = tx.Exec(ctx, sql, vid, data, sid, expires)
+			} else {
+				// PUBLISH function
+				sql = "INSERT INTO data (VID, PAYLOAD, PROVIDERID, CREATIONDATE, DURATION, " +
+					"MAXREADS, READERS" + regionColumn() + ") VALUES ($1, $2, $3, NOW(), $4, $5, $6" +
+					regionValue(providerRegionSQL("$3")) + ")"
+				_, err = tx.Exec(ctx, sql, vid, data, sid, duration, maxReads, readers)
+			}
+			if err == nil && len(words) > 0 && !isPublish {
+				err = insertSearchWordsTx(ctx, tx, vid, words)
 			}
-			LogInternalf("Failed to store payload (add/publish) with SQL: [%v] Error: %v", sql, pge)
-			return generateError(c, DV_INTERNAL_ERROR,
-				"Failed to store payload. Contact our support.")
+			return err
+		})
+		if getPgErrorCode(err) != "23505" {
+			break
 		}
-		break
+		// Duplicate key error. This might happen every now and then.
+		// Therefore, retry up to 4 times.
 	}
 	if err != nil {
-		LogInternalf("Failed to generate/insert some unique VID (add/publish)")
-		return generateError(c, DV_INTERNAL_ERROR,
+		LogInternalf("Failed to store payload (add/publish). Error: %v", err)
+		return generateDBError(c, err,
 			"Failed to store payload. Contact our support.")
 	}
 
-	// Add any possible search words (only add, not publish)
-	if len(words) > 0 && !isPublish {
-		if insertSearchWords(vid, words) != true {
-			deleteOneVID(vid) // Rollback payload entry
-			return generateError(c, DV_INTERNAL_ERROR,
-				"Failed to commit words insert. Contact our support.")
-		}
-	}
-
 	logType := LOG_TYPE_ADD
 	if isPublish {
 		logType = LOG_TYPE_PUBLISH
@@ -111,11 +145,244 @@ func doAdd(c echo.Context, clientRequest map[string]interface{}, isPublish bool)
 	rResult := make(map[string]interface{})
 	rResult["uid"] = uid
 	rResult["vid"] = vid
+	rResult["revision"] = 1
+	if expires.Status == pgtype.Present {
+		rResult["expires"] = FormatDateTime(expires.Time.UTC())
+	}
+	if ikey != "" {
+		storeIdempotencyResult(sid, ikey, rResult)
+	}
+	return generateResult(c, rResult)
+}
+
+// getReaders returns the sids allowed to read some published entry
+// (readers field). If there is none, the result has Null status.
+func getReaders(clientRequest map[string]interface{}) (pgtype.Int8Array, error) {
+	list := GetStringArray(clientRequest["readers"], []string{})
+	readers := pgtype.Int8Array{Status: pgtype.Null}
+	if len(list) == 0 {
+		return readers, nil
+	}
+	sids := make([]int64, len(list))
+	for i, s := range list {
+		sid, err := strconv.Atoi(s)
+		if err != nil || sid < 1 {
+			return readers, errors.New("Invalid sid in readers")
+		}
+		sids[i] = int64(sid)
+	}
+	err := readers.Set(sids)
+	return readers, err
+}
+
+// getSearchWords returns the search words of the given request or
+// batch item. Every word is either some SearchHash or some object
+// {"field": "name", "hash": "SearchHash"}. Tagged words are returned
+// as "field:hash" (see SplitSearchWord).
+func getSearchWords(request map[string]interface{}) ([]string, error) {
+	list, ok := request["words"].([]interface{})
+	if !ok {
+		return []string{}, nil
+	}
+	words := make([]string, 0, len(list))
+	for _, w := range list {
+		if m, ok := w.(map[string]interface{}); ok {
+			field := GetString(m["field"], "")
+			hash := GetString(m["hash"], "")
+			if !ValidateSearchField(field) || !ValidateSearchWord(hash) {
+				return nil, errors.New("Invalid field or hash in words")
+			}
+			words = append(words, field+":"+hash)
+			continue
+		}
+		word := GetString(w, "")
+		if strings.Contains(word, ":") {
+			return nil, errors.New("Invalid search word encoding")
+		}
+		words = append(words, word)
+	}
+	return words, nil
+}
+
+// batchItem is one item of a batch operation. It is also used
+// for single updates.
+type batchItem struct {
+	index       int
+	data        string
+	words       []string
+	vid         string
+	revision    int
+	expires     pgtype.Timestamptz // Null if not given
+	newRevision int                // set by updatePayloadTx
+}
+
+// expiresArg returns the expiry of the item as SQL argument. Items
+// without expiry (Undefined status) are passed as Null, because pgtype
+// can not encode Undefined values.
+func (item *batchItem) expiresArg() pgtype.Timestamptz {
+	if item.expires.Status == pgtype.Undefined {
+		return pgtype.Timestamptz{Status: pgtype.Null}
+	}
+	return item.expires
+}
+
+// getExpiry returns the expiry of the given request or batch item
+// (see ParseExpiry). If there is none, the result has Null status.
+func getExpiry(request map[string]interface{}) (pgtype.Timestamptz, error) {
+	t, err := ParseExpiry(GetString(request["expires"], ""),
+		GetInt(request["retention"], 0))
+	if err != nil || t.IsZero() {
+		return pgtype.Timestamptz{Status: pgtype.Null}, err
+	}
+	return pgtype.Timestamptz{Time: t, Status: pgtype.Present}, nil
+}
+
+// doAddBatch implements the "addbatch" api operation
+func doAddBatch(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	items := GetMapArray(clientRequest["items"], nil)
+	ikey := GetString(clientRequest["idempotencykey"], "")
+
+	if len(items) == 0 || sid == 0 {
+		return generateError(c, DV_MISSING_PARAM, "Missing items")
+	}
+	if len(items) > CNF_MAX_BATCH_ITEMS {
+		return generateError(c, DV_INVALID_PARAMSIZE,
+			"Maximum "+strconv.Itoa(CNF_MAX_BATCH_ITEMS)+" items allowed")
+	}
+
+	if ikey != "" {
+		if done, err := reserveIdempotencyKey(c, sid, "addbatch", ikey); done {
+			return err // already processed
+		}
+		defer releaseIdempotencyKey(sid, ikey)
+	}
+
+	// Validate all items. Invalid items get their error result, all
+	// others are inserted later.
+	results := make([]interface{}, len(items))
+	pending := []*batchItem{}
+	total := 0
+	for i, item := range items {
+		data := GetString(item["data"], "")
+		total += len(data)
+		if data == "" {
+			results[i] = generateItemError(DV_MISSING_PARAM, "Missing data")
+			continue
+		}
+		if len(data) > CNF_MAX_PAYLOAD_MB*1024*1024 {
+			results[i] = generateItemError(DV_INVALID_PARAMSIZE,
+				"Data bigger than "+strconv.Itoa(CNF_MAX_PAYLOAD_MB)+"MB")
+			continue
+		}
+		expires, err := getExpiry(item)
+		if err != nil {
+			results[i] = generateItemError(DV_INVALID_PARAMSIZE, err.Error())
+			continue
+		}
+		words, err := getSearchWords(item)
+		if err != nil {
+			results[i] = generateItemError(DV_INVALID_ENCODING, err.Error())
+			continue
+		}
+		if err := checkSearchWordCount(len(MakeUnique(words))); err != nil {
+			results[i] = generateItemError(DV_INVALID_PARAMSIZE, err.Error())
+			continue
+		}
+		pending = append(pending, &batchItem{
+			index:   i,
+			data:    data,
+			words:   words,
+			expires: expires,
+		})
+	}
+	if total > CNF_MAX_BATCH_PAYLOAD_MB*1024*1024 {
+		return generateError(c, DV_INVALID_PARAMSIZE,
+			"Data bigger than "+strconv.Itoa(CNF_MAX_BATCH_PAYLOAD_MB)+"MB in total")
+	}
+
+	// Insert in chunks, using one transaction per chunk
+	for start := 0; start < len(pending); start += CNF_BATCH_CHUNK_SIZE {
+		end := start + CNF_BATCH_CHUNK_SIZE
+		if end > len(pending) {
+			end = len(pending)
+		}
+		chunk := pending[start:end]
+		err := insertBatchChunk(ctx, sid, chunk)
+		if err != nil {
+			LogInternalf("Failed to store payloads (addbatch). Error: %v", err)
+		}
+		vids := make([]string, len(chunk))
+		for i, item := range chunk {
+			if err != nil {
+				results[item.index] = generateItemError(getDBErrorDetails(err,
+					"Failed to store payload. Contact our support."))
+				continue
+			}
+			iResult := make(map[string]interface{})
+			iResult["status"] = "OK"
+			iResult["vid"] = item.vid
+			iResult["revision"] = 1
+			if item.expires.Status == pgtype.Present {
+				iResult["expires"] = FormatDateTime(item.expires.Time.UTC())
+			}
+			results[item.index] = iResult
+			vids[i] = item.vid
+		}
+		if err == nil {
+			go DoLog(LOG_TYPE_ADD, sid, strings.Join(vids, " "))
+		}
+	}
+
+	// Return the item uid values like single add calls do
+	for i, item := range items {
+		results[i].(map[string]interface{})["uid"] = GetString(item["uid"], "")
+	}
+
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["items"] = results
+	if ikey != "" {
+		storeIdempotencyResult(sid, ikey, rResult)
+	}
 	return generateResult(c, rResult)
 }
 
+// insertBatchChunk inserts all given items and their search words
+// using one transaction. The new VIDs are assigned to the items.
+func insertBatchChunk(ctx context.Context, sid int, items []*batchItem) error {
+	var err error
+	sql := "INSERT INTO data (VID, PAYLOAD, PROVIDERID, CREATIONDATE, EXPIRES" + regionColumn() +
+		") VALUES ($1, $2, $3, NOW(), $4" + regionValue(providerRegionSQL("$3")) + ")"
+	for try := 0; try < 4; try++ {
+		err = execTx(ctx, "addbatch", func(tx pgx.Tx) error {
+			for _, item := range items {
+				item.vid = GenerateVID()
+				_, err := tx.Exec(ctx, sql, item.vid, item.data, sid, item.expires)
+				if err == nil && len(item.words) > 0 {
+					err = insertSearchWordsTx(ctx, tx, item.vid, item.words)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if getPgErrorCode(err) != "23505" {
+			return err
+		}
+		// Duplicate key error. This might happen every now and then.
+		// Therefore, retry up to 4 times with new VIDs.
+	}
+	return err
+}
+
 // doDelete implements the "delete" api operation
 func doDelete(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
 	uid := GetString(clientRequest["uid"], "")
 	sid := GetInt(clientRequest["sid"], 0)
 	vidList := GetString(clientRequest["vid"], "")
@@ -135,60 +402,237 @@ func doDelete(c echo.Context, clientRequest map[string]interface{}) error {
 		}
 	}
 
-	// Start transaction
-	tx, err := DB.Begin()
+	// Array argument for ANY()
+	vidArr := VIDArray(vids)
+
+	// With some grace period, the entries are only marked as deleted.
+	// They are purged by cleanupHeartBeat later.
+	grace := 0
+	err := execTx(ctx, "delete", func(tx pgx.Tx) error {
+		// Entries on legal hold must not get deleted. The check is part
+		// of the transaction, so holds placed meanwhile are respected.
+		held, err := getHeldVID(ctx, tx, sid, vids)
+		if err != nil {
+			LogInternalf("Failed to query holds (delete). Error: %v", err)
+			return &dvError{DV_INTERNAL_ERROR, "Failed to delete", err}
+		}
+		if held != "" {
+			return &dvError{DV_LEGAL_HOLD, "VID " + held + " is on legal hold", nil}
+		}
+
+		sql := "SELECT DELETEGRACEDAYS FROM provider WHERE PROVIDERID=$1"
+		err = tx.QueryRow(ctx, sql, sid).Scan(&grace)
+		if err != nil {
+			LogInternalf("Failed to query grace period (delete) with SQL: [%v] Error: %v", sql, err)
+			return &dvError{DV_INTERNAL_ERROR, "Failed to delete", err}
+		}
+		if grace > 0 {
+			sql = "UPDATE data SET DELETED=NOW() WHERE VID=ANY($2::BYTES[]) AND PROVIDERID=$1 AND DELETED IS NULL"
+			_, err = tx.Exec(ctx, sql, sid, vidArr)
+			if err != nil {
+				LogInternalf("Failed to mark payload as deleted (delete) with SQL: [%v] Error: %v", sql, err)
+				return &dvError{DV_INTERNAL_ERROR, "Failed to delete", err}
+			}
+			return nil
+		}
+
+		// First delete any possible search words.
+		sql = `DELETE FROM search WHERE VID IN(
+			      SELECT VID FROM data WHERE VID=ANY($2::BYTES[]) AND PROVIDERID=$1
+				)`
+		_, err = tx.Exec(ctx, sql, sid, vidArr)
+		if err != nil {
+			LogInternalf("Failed to delete searchwords (delete) with SQL: [%v] Error: %v", sql, err)
+			return &dvError{DV_INTERNAL_ERROR, "Failed to delete search words", err}
+		}
+
+		// Also delete all previous versions (history).
+		sql = `DELETE FROM history WHERE VID IN(
+			      SELECT VID FROM data WHERE VID=ANY($2::BYTES[]) AND PROVIDERID=$1
+				)`
+		_, err = tx.Exec(ctx, sql, sid, vidArr)
+		if err != nil {
+			LogInternalf("Failed to delete history (delete) with SQL: [%v] Error: %v", sql, err)
+			return &dvError{DV_INTERNAL_ERROR, "Failed to delete history", err}
+		}
+
+		// Now delete the payload data.
+		sql = "DELETE FROM data WHERE VID=ANY($2::BYTES[]) AND PROVIDERID=$1"
+		_, err = tx.Exec(ctx, sql, sid, vidArr)
+		if err != nil {
+			LogInternalf("Failed to delete payload (delete) with SQL: [%v] Error: %v", sql, err)
+			return &dvError{DV_INTERNAL_ERROR, "Failed to delete", err}
+		}
+		return nil
+	})
 	if err != nil {
-		LogInternalf("Failed to start transaction (delete). Error: %v", err)
-		return generateError(c, DV_INTERNAL_ERROR,
-			"Failed to start a new transaction. Contact our support.")
+		code, desc := getTxErrorDetails(err, "delete")
+		return generateError(c, code, desc)
 	}
 
-	// Concat ANY() statement
-	in := "'{" + strings.Join(vids, ",") + "}'"
+	if grace > 0 {
+		go DoLog(LOG_TYPE_DELETE, sid,
+			fmt.Sprintf("%v (grace period %d days)", vidList, grace))
+	} else {
+		go DoLog(LOG_TYPE_DELETE, sid, vidList)
+	}
 
-	// First delete any possible search words.
-	sql := `DELETE FROM search WHERE VID IN(
-		      SELECT VID FROM data WHERE VID=ANY(` + in + `::bytes[]) AND PROVIDERID=$1
-			)`
-	_, err = tx.Exec(sql, sid)
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	return generateResult(c, rResult)
+}
+
+// doUndelete implements the "undelete" api operation
+func doUndelete(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	vidList := GetString(clientRequest["vid"], "")
+	vids := GetStringArray(clientRequest["vid"], []string{})
+
+	if len(vids) == 0 {
+		vids = strings.SplitN(vidList, " ", -1)
+	}
+	if len(vids) < 1 {
+		return generateError(c, DV_MISSING_PARAM, "No VID?")
+	}
+	// Validate all VIDs for validity (also security).
+	vids = MakeUnique(vids) // Ensure there are no duplicates
+	for _, v := range vids {
+		if !ValidateVID(v) {
+			return generateError(c, DV_VID_NOT_FOUND, "Invalid VID "+v)
+		}
+	}
+
+	// Only entries within the grace period of the provider are restored.
+	sql := `UPDATE data SET DELETED=NULL
+			WHERE VID=ANY($2::BYTES[]) AND PROVIDERID=$1 AND
+				DELETED > NOW() - (SELECT DELETEGRACEDAYS FROM provider
+					WHERE PROVIDERID=$1) * INTERVAL '1 day'
+			RETURNING VID`
+	rows, err := DB.Query(ctx, sql, sid, VIDArray(vids))
 	if err != nil {
-		tx.Rollback()
-		LogInternalf("Failed to delete searchwords (delete) with SQL: [%v] Error: %v", sql, err)
-		return generateError(c, DV_INTERNAL_ERROR, "Failed to delete search words")
+		LogInternalf("Failed to restore payload (undelete) with SQL: [%v] Error: %v", sql, err)
+		return generateDBError(c, err,
+			"Failed to restore. Contact our support.")
+	}
+	defer rows.Close()
+
+	restored := []string{}
+	for rows.Next() {
+		var vid pgtype.Varchar
+		err = rows.Scan(&vid)
+		if err != nil {
+			LogInternalf("Unexpected error while processing result (undelete). Error: %v", err)
+			continue
+		}
+		restored = append(restored, vid.String)
+	}
+	if rows.Err() != nil {
+		LogInternalf("Failed to restore payload (undelete). Error: %v", rows.Err())
+		return generateDBError(c, rows.Err(),
+			"Failed to restore. Contact our support.")
+	}
+
+	if len(restored) > 0 {
+		go DoLog(LOG_TYPE_UNDELETE, sid, strings.Join(restored, " "))
 	}
 
-	// Now delete the payload data.
-	sql = "DELETE FROM data WHERE VID=ANY(" + in + "::bytes[]) AND PROVIDERID=$1"
-	_, err = tx.Exec(sql, sid)
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["vids"] = restored
+	return generateResult(c, rResult)
+}
+
+// doRepublish implements the "republish" api operation. It changes the
+// remaining duration of some published entry by setting its EXPIRES
+// date (overrides CREATIONDATE + DURATION).
+func doRepublish(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	vid := GetString(clientRequest["vid"], "")
+	duration := GetInt(clientRequest["duration"], 0)
+
+	if duration < 1 || duration > CNF_MAX_PUBLISH_DAYS {
+		return generateError(c, DV_INVALID_PARAMSIZE, "Invalid duration range")
+	}
+	if !ValidateVID(vid) {
+		return generateError(c, DV_VID_NOT_FOUND, "Invalid VID")
+	}
+
+	var expires pgtype.Timestamptz
+	sql := `UPDATE data SET EXPIRES = NOW() + $3 * INTERVAL '1 day'
+			WHERE VID=$1 AND PROVIDERID=$2 AND DURATION > 0 AND
+				REVOKED IS NULL AND DELETED IS NULL
+			RETURNING EXPIRES`
+	err := DB.QueryRow(ctx, sql, vid, sid, duration).Scan(&expires)
+	if err == pgx.ErrNoRows {
+		return generateError(c, DV_VID_NOT_FOUND, "Published entry with this VID not found")
+	}
 	if err != nil {
-		tx.Rollback()
-		LogInternalf("Failed to delete payload (delete) with SQL: [%v] Error: %v", sql, err)
-		return generateError(c, DV_INTERNAL_ERROR, "Failed to delete")
+		LogInternalf("Failed to update duration (republish) with SQL: [%v] Error: %v", sql, err)
+		return generateDBError(c, err,
+			"Failed to republish. Contact our support.")
+	}
+
+	go DoLog(LOG_TYPE_PUBLISH, sid, fmt.Sprintf("%v (republished for %d days)", vid, duration))
+
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["vid"] = vid
+	rResult["expires"] = FormatDateTime(expires.Time.UTC())
+	return generateResult(c, rResult)
+}
+
+// doRevoke implements the "revoke" api operation. Revoked entries are
+// no longer returned by getpublished. They are deleted at the end of
+// their duration like all other published entries.
+func doRevoke(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	vid := GetString(clientRequest["vid"], "")
+
+	if !ValidateVID(vid) {
+		return generateError(c, DV_VID_NOT_FOUND, "Invalid VID")
 	}
 
-	err = tx.Commit()
+	sql := `UPDATE data SET REVOKED = NOW()
+			WHERE VID=$1 AND PROVIDERID=$2 AND DURATION > 0 AND
+				REVOKED IS NULL AND DELETED IS NULL`
+	ctag, err := DB.Exec(ctx, sql, vid, sid)
 	if err != nil {
-		tx.Rollback()
-		LogInternalf("Failed to commit delete. Error: %v", err)
-		return generateError(c, DV_INTERNAL_ERROR,
-			"Failed to commit deletions. Contact our support.")
+		LogInternalf("Failed to revoke (revoke) with SQL: [%v] Error: %v", sql, err)
+		return generateDBError(c, err,
+			"Failed to revoke. Contact our support.")
+	}
+	if ctag.RowsAffected() != 1 {
+		return generateError(c, DV_VID_NOT_FOUND, "Published entry with this VID not found")
 	}
 
-	go DoLog(LOG_TYPE_DELETE, sid, vidList)
+	go DoLog(LOG_TYPE_PUBLISH, sid, vid+" (revoked)")
 
 	// Compile result
 	rResult := make(map[string]interface{})
 	rResult["uid"] = uid
+	rResult["vid"] = vid
 	return generateResult(c, rResult)
 }
 
 // doUpdate implements the "update" api operation
 func doUpdate(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
 	data := GetString(clientRequest["data"], "")
 	vid := GetString(clientRequest["vid"], "")
 	uid := GetString(clientRequest["uid"], "")
 	sid := GetInt(clientRequest["sid"], 0)
-	words := GetStringArray(clientRequest["words"], []string{})
+	words, wordsErr := getSearchWords(clientRequest)
+	revision := GetInt(clientRequest["revision"], 0)
+	expires, err := getExpiry(clientRequest)
 
 	if data == "" || sid == 0 {
 		return generateError(c, DV_MISSING_PARAM, "Missing data")
@@ -200,77 +644,528 @@ func doUpdate(c echo.Context, clientRequest map[string]interface{}) error {
 	if !ValidateVID(vid) {
 		return generateError(c, DV_VID_NOT_FOUND, "Invalid VID")
 	}
+	if err != nil {
+		return generateError(c, DV_INVALID_PARAMSIZE, err.Error())
+	}
+	if wordsErr != nil {
+		return generateError(c, DV_INVALID_ENCODING, wordsErr.Error())
+	}
+	if err := checkSearchWordCount(len(MakeUnique(words))); err != nil {
+		return generateError(c, DV_INVALID_PARAMSIZE, err.Error())
+	}
+
+	// Payload, history and search words are changed in one transaction
+	item := batchItem{data: data, words: words, vid: vid, revision: revision,
+		expires: expires}
+	err = execTx(ctx, "update", func(tx pgx.Tx) error {
+		return updatePayloadTx(ctx, tx, sid, &item)
+	})
+	if err != nil {
+		code, desc := getTxErrorDetails(err, "update")
+		return generateError(c, code, desc)
+	}
+
+	go DoLog(LOG_TYPE_UPDATE, sid, vid)
+
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["revision"] = item.newRevision
+	if expires.Status == pgtype.Present {
+		rResult["expires"] = FormatDateTime(expires.Time.UTC())
+	}
+	return generateResult(c, rResult)
+}
+
+// doUpdateBatch implements the "updatebatch" api operation
+func doUpdateBatch(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	items := GetMapArray(clientRequest["items"], nil)
+	atomic := GetBool(clientRequest["atomic"], false)
+
+	if len(items) == 0 || sid == 0 {
+		return generateError(c, DV_MISSING_PARAM, "Missing items")
+	}
+	if len(items) > CNF_MAX_BATCH_ITEMS {
+		return generateError(c, DV_INVALID_PARAMSIZE,
+			"Maximum "+strconv.Itoa(CNF_MAX_BATCH_ITEMS)+" items allowed")
+	}
+
+	// Validate all items. Invalid items get their error result, all
+	// others are updated later.
+	results := make([]interface{}, len(items))
+	pending := []*batchItem{}
+	failed := false
+	total := 0
+	for i, item := range items {
+		data := GetString(item["data"], "")
+		vid := GetString(item["vid"], "")
+		expires, err := getExpiry(item)
+		words, wordsErr := getSearchWords(item)
+		total += len(data)
+		if data == "" {
+			results[i] = generateItemError(DV_MISSING_PARAM, "Missing data")
+		} else if len(data) > CNF_MAX_PAYLOAD_MB*1024*1024 {
+			results[i] = generateItemError(DV_INVALID_PARAMSIZE,
+				"Data bigger than "+strconv.Itoa(CNF_MAX_PAYLOAD_MB)+"MB")
+		} else if !ValidateVID(vid) {
+			results[i] = generateItemError(DV_VID_NOT_FOUND, "Invalid VID")
+		} else if err != nil {
+			results[i] = generateItemError(DV_INVALID_PARAMSIZE, err.Error())
+		} else if wordsErr != nil {
+			results[i] = generateItemError(DV_INVALID_ENCODING, wordsErr.Error())
+		} else if err := checkSearchWordCount(len(MakeUnique(words))); err != nil {
+			results[i] = generateItemError(DV_INVALID_PARAMSIZE, err.Error())
+		} else {
+			pending = append(pending, &batchItem{
+				index:    i,
+				data:     data,
+				words:    words,
+				vid:      vid,
+				revision: GetInt(item["revision"], 0),
+				expires:  expires,
+			})
+			continue
+		}
+		failed = true
+	}
+	if total > CNF_MAX_BATCH_PAYLOAD_MB*1024*1024 {
+		return generateError(c, DV_INVALID_PARAMSIZE,
+			"Data bigger than "+strconv.Itoa(CNF_MAX_BATCH_PAYLOAD_MB)+"MB in total")
+	}
 
-	// Validate VID
+	updated := []string{}
+	if atomic {
+		// All items are updated in one transaction. If one item fails,
+		// all others are cancelled.
+		if !failed {
+			updated, failed = updateBatchItems(ctx, sid, pending, results)
+		}
+		if failed {
+			updated = []string{}
+		}
+	} else {
+		// Every item is updated in its own transaction
+		for _, item := range pending {
+			done, _ := updateBatchItems(ctx, sid, []*batchItem{item}, results)
+			updated = append(updated, done...)
+		}
+	}
+
+	for i, item := range items {
+		if results[i] == nil {
+			iResult := make(map[string]interface{})
+			iResult["status"] = "CANCELLED"
+			results[i] = iResult
+		}
+		results[i].(map[string]interface{})["uid"] = GetString(item["uid"], "")
+		results[i].(map[string]interface{})["vid"] = GetString(item["vid"], "")
+	}
+
+	if len(updated) > 0 {
+		go DoLog(LOG_TYPE_UPDATE, sid, strings.Join(updated, " "))
+	}
+
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["items"] = results
+	return generateResult(c, rResult)
+}
+
+// updateBatchItems updates the given items using one transaction and
+// sets their results. It returns the updated VIDs and true if some
+// item failed. It stops at the first failing item and rolls back, so
+// the results of all other items are not set then.
+func updateBatchItems(ctx context.Context, sid int, items []*batchItem, results []interface{}) ([]string, bool) {
+	var failed *batchItem
+	err := execTx(ctx, "updatebatch", func(tx pgx.Tx) error {
+		for _, item := range items {
+			failed = item
+			if err := updatePayloadTx(ctx, tx, sid, item); err != nil {
+				return err
+			}
+		}
+		failed = nil
+		return nil
+	})
+	if err != nil {
+		code, desc := getTxErrorDetails(err, "updatebatch")
+		var dve *dvError
+		if failed != nil && errors.As(err, &dve) {
+			results[failed.index] = generateItemError(code, desc)
+			return nil, true
+		}
+		for _, item := range items {
+			results[item.index] = generateItemError(code, desc)
+		}
+		return nil, true
+	}
+
+	vids := make([]string, len(items))
+	for i, item := range items {
+		iResult := make(map[string]interface{})
+		iResult["status"] = "OK"
+		iResult["revision"] = item.newRevision
+		if item.expires.Status == pgtype.Present {
+			iResult["expires"] = FormatDateTime(item.expires.Time.UTC())
+		}
+		results[item.index] = iResult
+		vids[i] = item.vid
+	}
+	return vids, false
+}
+
+// getUpdatableRevisionTx returns the current revision of the given VID
+// using the given transaction (op is only used for logging). The VID
+// must belong to the provider sid and must not be a published, expired,
+// deleted or held one. Otherwise, it returns some *dvError.
+func getUpdatableRevisionTx(ctx context.Context, tx pgx.Tx, sid int, vid string, op string) (int, error) {
 	pid := 0
 	duration := 0
-	sql := "SELECT PROVIDERID, DURATION FROM data WHERE VID=$1 AND PROVIDERID=$2"
-	DB.QueryRow(sql, vid, sid).Scan(&pid, &duration)
+	revision := 0
+	sql := `SELECT PROVIDERID, DURATION, REVISION FROM data WHERE VID=$1 AND PROVIDERID=$2
+			AND (EXPIRES IS NULL OR EXPIRES > NOW()) AND DELETED IS NULL`
+	err := tx.QueryRow(ctx, sql, vid, sid).Scan(&pid, &duration, &revision)
+	if err != nil && err != pgx.ErrNoRows {
+		LogInternalf("Failed to query entry (%v). SQL: %v Error: %v", op, sql, err)
+		return 0, &dvError{DV_INTERNAL_ERROR, "Failed to update entry. Contact our support.", err}
+	}
 	if pid < 1 {
-		return generateError(c, DV_VID_NOT_FOUND, "Entry with this VID not found")
+		return 0, &dvError{DV_VID_NOT_FOUND, "Entry with this VID not found", nil}
 	}
 	if duration != 0 {
-		return generateError(c, DV_INVALID_FOR_PUBLISHED,
-			"Published entries are not allowed to update")
+		return 0, &dvError{DV_INVALID_FOR_PUBLISHED,
+			"Published entries are not allowed to update", nil}
 	}
+	held, err := getHeldVID(ctx, tx, sid, []string{vid})
+	if err != nil {
+		LogInternalf("Failed to query holds (%v). Error: %v", op, err)
+		return 0, &dvError{DV_INTERNAL_ERROR, "Failed to update entry. Contact our support.", err}
+	}
+	if held != "" {
+		return 0, &dvError{DV_LEGAL_HOLD, "Entry is on legal hold", nil}
+	}
+	return revision, nil
+}
 
-	// Delete any search words.
-	// Start transaction
-	tx, err := DB.Begin()
+// updatePayloadTx replaces the payload and the search words of the
+// given item using the given transaction. The VID must belong to the
+// provider sid and must not be a published, expired, deleted or held
+// one. If the item has some revision, it must match the current
+// revision of the VID.
+// If the item has some expiry, it replaces the current one.
+// On success, it returns nil and sets the newRevision of the item.
+// Otherwise, it returns some *dvError. The transaction is not rolled
+// back.
+func updatePayloadTx(ctx context.Context, tx pgx.Tx, sid int, item *batchItem) error {
+	vid := item.vid
+	revision, err := getUpdatableRevisionTx(ctx, tx, sid, vid, "update")
+	if err != nil {
+		return err
+	}
+	if item.revision > 0 && item.revision != revision {
+		return &dvError{DV_REVISION_CONFLICT,
+			"Entry was modified in the meantime (current revision is " +
+				strconv.Itoa(revision) + ")", nil}
+	}
+
+	// Keep the current version in history (if enabled for this provider)
+	// and remove all versions exceeding the configured number.
+	sql := `UPSERT INTO history (VID, REVISION, PAYLOAD, WORDS, ARCHIVEDATE` + regionColumn() + `)
+			SELECT VID, REVISION, PAYLOAD, ARRAY(SELECT ` + SQL_SEARCH_WORD + `
+				FROM search WHERE VID=$1), NOW()` + regionValue("crdb_region") + `
+			FROM data WHERE VID=$1 AND
+				(SELECT HISTORY FROM provider WHERE PROVIDERID=$2) > 0`
+	_, err = tx.Exec(ctx, sql, vid, sid)
+	if err != nil {
+		LogInternalf("Failed to store history (update). SQL: %v Error: %v", sql, err)
+		return &dvError{DV_INTERNAL_ERROR, "Failed to store history. Contact our support.", err}
+	}
+	sql = `DELETE FROM history WHERE VID=$1 AND
+			REVISION <= $2 - (SELECT HISTORY FROM provider WHERE PROVIDERID=$3)`
+	_, err = tx.Exec(ctx, sql, vid, revision, sid)
 	if err != nil {
-		LogInternalf("Failed to start db transaction (update). Error: %v", err)
-		return generateError(c, DV_INTERNAL_ERROR,
-			"Failed to create new transaction. Contact our support.")
+		LogInternalf("Failed to cleanup history (update). SQL: %v Error: %v", sql, err)
+		return &dvError{DV_INTERNAL_ERROR, "Failed to cleanup history. Contact our support.", err}
 	}
+
+	// Delete any search words.
 	sql = "DELETE FROM search WHERE VID=$1"
-	_, err = tx.Exec(sql, vid)
+	_, err = tx.Exec(ctx, sql, vid)
 	if err != nil {
-		tx.Rollback()
 		LogInternalf("Failed to delete words (update). SQL: %v Error: %v", sql, err)
-		return generateError(c, DV_INTERNAL_ERROR,
-			"Failed to delete searchwords. Contact our support.")
+		return &dvError{DV_INTERNAL_ERROR, "Failed to delete searchwords. Contact our support.", err}
 	}
 
 	// Update dataset
-	sql = "UPDATE data SET PAYLOAD=$1 WHERE VID=$2"
-	_, err = tx.Exec(sql, data, vid)
+	sql = `UPDATE data SET PAYLOAD=$1, REVISION=$2, EXPIRES=COALESCE($4, EXPIRES),
+			UPDATEDATE=NOW() WHERE VID=$3`
+	_, err = tx.Exec(ctx, sql, item.data, revision+1, vid, item.expiresArg())
 	if err != nil {
-		tx.Rollback()
 		LogInternalf("Failed to delete payload (update). SQL: %v Error: %v", sql, err)
-		return generateError(c, DV_INTERNAL_ERROR,
-			"Failed to update payload. Contact our support.")
+		return &dvError{DV_INTERNAL_ERROR, "Failed to update payload. Contact our support.", err}
 	}
 
 	// Insert new searchwords
-	if len(words) > 0 {
-		if insertSearchWords(vid, words) != true {
-			tx.Rollback()
-			return generateError(c, DV_INTERNAL_ERROR,
-				"Failed to commit words update/insert. Contact our support.")
+	if len(item.words) > 0 {
+		err = insertSearchWordsTx(ctx, tx, vid, item.words)
+		var dve *dvError
+		if errors.As(err, &dve) {
+			return err // too many words (eg revert of some old revision)
+		}
+		if err != nil {
+			LogInternalf("Failed to store words (update). Error: %v", err)
+			return &dvError{DV_INTERNAL_ERROR,
+				"Failed to commit words update/insert. Contact our support.", err}
 		}
 	}
-	err = tx.Commit()
+	item.newRevision = revision + 1
+	return nil
+}
+
+// doChangeWords implements the "addwords" and "removewords" api
+// operations. They change the search words of one entry without
+// changing its payload (and revision).
+func doChangeWords(c echo.Context, clientRequest map[string]interface{}, remove bool) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	vid := GetString(clientRequest["vid"], "")
+	words, err := getSearchWords(clientRequest)
+
+	op := "addwords"
+	if remove {
+		op = "removewords"
+	}
+	if !ValidateVID(vid) {
+		return generateError(c, DV_VID_NOT_FOUND, "Invalid VID")
+	}
 	if err != nil {
-		tx.Rollback()
-		LogInternalf("Failed to commit update. Error: %v", err)
-		return generateError(c, DV_INTERNAL_ERROR,
-			"Failed to update. Contact our support.")
+		return generateError(c, DV_INVALID_ENCODING, err.Error())
+	}
+	words = MakeUnique(words) // remove any duplicates
+	if len(words) < 1 {
+		return generateError(c, DV_MISSING_PARAM, "Missing words")
+	}
+	for _, word := range words {
+		if _, hash := SplitSearchWord(word); !ValidateSearchWord(hash) {
+			return generateError(c, DV_INVALID_ENCODING, "Invalid search word encoding")
+		}
 	}
 
-	go DoLog(LOG_TYPE_UPDATE, sid, vid)
+	// Start transaction
+	changed := 0
+	err = execTx(ctx, op, func(tx pgx.Tx) error {
+		if _, err := getUpdatableRevisionTx(ctx, tx, sid, vid, op); err != nil {
+			return err
+		}
+
+		// Add or remove the words. Existing words are not added twice.
+		changed = 0
+		sql := `INSERT INTO search (VID, WORD, FIELD` + regionColumn() + `)
+				SELECT $1, $2, $3` + regionValue(dataRegionSQL("$1")) + `
+				WHERE NOT EXISTS (SELECT 1 FROM search
+					WHERE VID=$1 AND WORD=$2 AND FIELD=$3)`
+		if remove {
+			sql = "DELETE FROM search WHERE VID=$1 AND WORD=$2 AND FIELD=$3"
+		}
+		for _, word := range words {
+			field, hash := SplitSearchWord(word)
+			ctag, err := tx.Exec(ctx, sql, vid, hash, field)
+			if err != nil {
+				LogInternalf("Failed to change words (%v). SQL: %v Error: %v", op, sql, err)
+				return &dvError{DV_INTERNAL_ERROR,
+					"Failed to update search words. Contact our support.", err}
+			}
+			changed += int(ctag.RowsAffected())
+		}
+
+		// Added words must not exceed the limit per VID (see checksearch)
+		if !remove {
+			count := 0
+			err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM search WHERE VID=$1", vid).Scan(&count)
+			if err != nil {
+				LogInternalf("Failed to count words (%v). Error: %v", op, err)
+				return &dvError{DV_INTERNAL_ERROR,
+					"Failed to update search words. Contact our support.", err}
+			}
+			if err := checkSearchWordCount(count); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(ctx, "UPDATE data SET UPDATEDATE=NOW() WHERE VID=$1", vid)
+		return err
+	})
+	if err != nil {
+		code, desc := getTxErrorDetails(err, op)
+		return generateError(c, code, desc)
+	}
+
+	go DoLog(LOG_TYPE_UPDATE, sid, vid+" ("+op+")")
+
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["vid"] = vid
+	rResult["changed"] = changed
+	return generateResult(c, rResult)
+}
+
+// doHistory implements the "history" api operation
+func doHistory(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	vid := GetString(clientRequest["vid"], "")
+
+	if !ValidateVID(vid) {
+		return generateError(c, DV_VID_NOT_FOUND, "Invalid VID")
+	}
+
+	// Validate VID (history is only available for own, regular entries)
+	revision := 0
+	sql := `SELECT REVISION FROM data WHERE VID=$1 AND PROVIDERID=$2 AND DURATION < 1
+			AND DELETED IS NULL`
+	DB.QueryRow(ctx, sql, vid, sid).Scan(&revision)
+	if revision < 1 {
+		return generateError(c, DV_VID_NOT_FOUND, "Entry with this VID not found")
+	}
+
+	sql = "SELECT REVISION, ARCHIVEDATE FROM history WHERE VID=$1 ORDER BY REVISION DESC"
+	rows, err := DB.Query(ctx, sql, vid)
+	if err != nil {
+		LogInternalf("Failed to query (history) with SQL: %v Error: %v", sql, err)
+		return generateDBError(c, err,
+			"Failed to query. Contact our support.")
+	}
+	defer rows.Close()
+
+	versions := make([]interface{}, 0)
+	for rows.Next() {
+		var version pgtype.Int8
+		var archived pgtype.Timestamptz
+		err = rows.Scan(&version, &archived)
+		if err != nil {
+			LogInternalf("Unexpected error while processing query result (history). Error: %v", err)
+			continue
+		}
+		vResult := make(map[string]interface{})
+		vResult["revision"] = version.Int
+		vResult["archived"] = FormatDateTime(archived.Time)
+		versions = append(versions, vResult)
+	}
+
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["vid"] = vid
+	rResult["revision"] = revision
+	rResult["versions"] = versions
+	return generateResult(c, rResult)
+}
+
+// doGetVersion implements the "getversion" api operation
+func doGetVersion(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	vid := GetString(clientRequest["vid"], "")
+	revision := GetInt(clientRequest["revision"], 0)
+
+	if revision < 1 {
+		return generateError(c, DV_MISSING_PARAM, "Missing revision")
+	}
+	if !ValidateVID(vid) {
+		return generateError(c, DV_VID_NOT_FOUND, "Invalid VID")
+	}
+
+	// The JOIN with data ensures the VID belongs to the provider
+	var payload pgtype.Varchar
+	sql := `SELECT h.PAYLOAD FROM history h
+			INNER JOIN data d ON (d.VID = h.VID)
+			WHERE h.VID=$1 AND h.REVISION=$2 AND d.PROVIDERID=$3 AND
+				d.DELETED IS NULL`
+	err := DB.QueryRow(ctx, sql, vid, revision, sid).Scan(&payload)
+	if err == pgx.ErrNoRows {
+		return generateError(c, DV_VID_NOT_FOUND, "Entry with this VID and revision not found")
+	}
+	if err != nil {
+		LogInternalf("Failed to query (getversion) with SQL: %v Error: %v", sql, err)
+		return generateDBError(c, err,
+			"Failed to query. Contact our support.")
+	}
 
 	// Compile result
 	rResult := make(map[string]interface{})
 	rResult["uid"] = uid
+	rResult["vid"] = vid
+	rResult["revision"] = revision
+	rResult["data"] = payload.String
+	return generateResult(c, rResult)
+}
+
+// doRevert implements the "revert" api operation
+func doRevert(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	vid := GetString(clientRequest["vid"], "")
+	revision := GetInt(clientRequest["revision"], 0)
+
+	if revision < 1 {
+		return generateError(c, DV_MISSING_PARAM, "Missing revision")
+	}
+	if !ValidateVID(vid) {
+		return generateError(c, DV_VID_NOT_FOUND, "Invalid VID")
+	}
+
+	// the expiry of the entry is kept
+	item := batchItem{vid: vid, expires: pgtype.Timestamptz{Status: pgtype.Null}}
+	err := execTx(ctx, "revert", func(tx pgx.Tx) error {
+		// Get the old version. Ownership is verified by updatePayloadTx.
+		var payload pgtype.Varchar
+		var words []string
+		sql := "SELECT PAYLOAD, WORDS FROM history WHERE VID=$1 AND REVISION=$2"
+		err := tx.QueryRow(ctx, sql, vid, revision).Scan(&payload, &words)
+		if err == pgx.ErrNoRows {
+			return &dvError{DV_VID_NOT_FOUND, "Entry with this VID and revision not found", nil}
+		}
+		if err != nil {
+			LogInternalf("Failed to query (revert) with SQL: %v Error: %v", sql, err)
+			return &dvError{DV_INTERNAL_ERROR, "Failed to query. Contact our support.", err}
+		}
+
+		// Store the old version like some regular update
+		item.data = payload.String
+		item.words = words
+		return updatePayloadTx(ctx, tx, sid, &item)
+	})
+	if err != nil {
+		code, desc := getTxErrorDetails(err, "revert")
+		return generateError(c, code, desc)
+	}
+
+	go DoLog(LOG_TYPE_UPDATE, sid, fmt.Sprintf("%v (reverted to revision %d)", vid, revision))
+
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["revision"] = item.newRevision
 	return generateResult(c, rResult)
 }
 
 // doGet implements the "get" api operation
 func doGet(c echo.Context, clientRequest map[string]interface{}, isPublish bool) error {
+	ctx := c.Request().Context()
 	uid := GetString(clientRequest["uid"], "")
 	sid := GetInt(clientRequest["sid"], 0)
 	vidList := GetString(clientRequest["vid"], "")
 	vids := GetStringArray(clientRequest["vid"], []string{})
+	withMeta := GetBool(clientRequest["meta"], false)
 
 	if len(vids) == 0 {
 		vids = strings.SplitN(vidList, " ", -1)
@@ -288,48 +1183,143 @@ func doGet(c echo.Context, clientRequest map[string]interface{}, isPublish bool)
 		vidMap[v] = true
 	}
 
-	// Concat ANY() statement and build the select.
-	// NOTE: PROVIDERID has to match. Published entried are not returned.
-	in := "'{" + strings.Join(vids, ",") + "}'"
+	// Build the select (VIDs as array argument for ANY()).
+	// NOTE: PROVIDERID has to match. Published, expired and deleted
+	// entries are not returned.
+	op := "get"
+	if isPublish {
+		op = "getpublished"
+	}
+	reader, err := newStaleReader(c, op, clientRequest)
+	if err != nil {
+		LogInternalf("Failed to start follower read (get). Error: %v", err)
+		return generateDBError(c, err,
+			"Failed to query. Contact our support.")
+	}
+	defer reader.close(ctx)
+
+	vidArr := VIDArray(vids)
 	sql := ""
-	var rows *pgx.Rows
-	var err error
+	var rows pgx.Rows
 	if isPublish == false {
 		// function "get"
-		sql = `SELECT VID, PAYLOAD FROM data 
-		    	WHERE VID=ANY(` + in + `::bytes[]) AND 
-					PROVIDERID=$1 AND DURATION < 1`
-		rows, err = DB.Query(sql, sid)
+		sql = `SELECT VID, PAYLOAD, REVISION, EXPIRES, REVOKED, MAXREADS, PROVIDERID,
+					CREATIONDATE, UPDATEDATE, DURATION FROM data 
+		    	WHERE VID=ANY($2::BYTES[]) AND
+					PROVIDERID=$1 AND DURATION < 1 AND
+					(EXPIRES IS NULL OR EXPIRES > NOW()) AND DELETED IS NULL`
+		rows, err = reader.db.Query(ctx, sql, sid, vidArr)
 	} else {
-		// function "getpublished"
-		sql = `SELECT VID, PAYLOAD FROM data 
-		    	WHERE VID=ANY(` + in + `::bytes[]) AND 
-					DURATION > 0`
-		rows, err = DB.Query(sql)
+		// function "getpublished" (EXPIRES is set by republish). Entries
+		// with READERS are only returned to the listed sids.
+		sql = `SELECT VID, PAYLOAD, REVISION,
+					COALESCE(EXPIRES, CREATIONDATE + DURATION * INTERVAL '1 day'),
+					REVOKED, MAXREADS, PROVIDERID,
+					CREATIONDATE, UPDATEDATE, DURATION FROM data 
+		    	WHERE VID=ANY($2::BYTES[]) AND
+					DURATION > 0 AND DELETED IS NULL AND
+					(EXPIRES IS NULL OR EXPIRES > NOW()) AND
+					(READERS IS NULL OR $1 = ANY(READERS)) AND
+					(MAXREADS = 0 OR READS < MAXREADS)`
+		rows, err = reader.db.Query(ctx, sql, sid, vidArr)
 	}
 	if err != nil {
 		LogInternalf("Failed to query (get) with SQL: %v Error: %v", sql, err)
-		return generateError(c, DV_INTERNAL_ERROR,
+		return generateDBError(c, err,
 			"Failed to query. Contact our support.")
 	}
 	defer rows.Close()
 
 	results := make(map[string]interface{})
+	limited := []string{} // VIDs with read limit (only getpublished)
+	owners := make(map[string]int)
 	for rows.Next() {
 		var vid pgtype.Varchar
 		var payload pgtype.Varchar
-		err = rows.Scan(&vid, &payload)
+		var revision pgtype.Int8
+		var expires pgtype.Timestamptz
+		var revoked pgtype.Timestamptz
+		var maxReads pgtype.Int8
+		var owner pgtype.Int2
+		var created pgtype.Timestamptz
+		var updated pgtype.Timestamptz
+		var duration pgtype.Int2
+		err = rows.Scan(&vid, &payload, &revision, &expires, &revoked, &maxReads, &owner,
+			&created, &updated, &duration)
 		if err != nil {
 			LogInternalf("Unexpected error while processing query result (get). Error: %v", err)
 			continue
 		}
 		dResult := make(map[string]interface{})
+		if revoked.Status == pgtype.Present {
+			// revoked by the publisher (only getpublished). Only the
+			// publisher gets to know, for all others it is missing.
+			if int(owner.Int) != sid {
+				continue
+			}
+			dResult["status"] = "REVOKED"
+			dResult["data"] = false
+			results[vid.String] = dResult
+			delete(vidMap, vid.String)
+			continue
+		}
 		dResult["status"] = "OK"
 		dResult["data"] = payload.String
+		dResult["revision"] = revision.Int
+		if expires.Status == pgtype.Present {
+			dResult["expires"] = FormatDateTime(expires.Time.UTC())
+		}
+		if withMeta {
+			// Optional metadata (opt-in by "meta" field)
+			mResult := make(map[string]interface{})
+			mResult["created"] = FormatDateTime(created.Time.UTC())
+			mResult["updated"] = nil
+			if updated.Status == pgtype.Present {
+				mResult["updated"] = FormatDateTime(updated.Time.UTC())
+			}
+			mResult["expires"] = nil
+			if expires.Status == pgtype.Present {
+				mResult["expires"] = FormatDateTime(expires.Time.UTC())
+			}
+			mResult["duration"] = duration.Int
+			mResult["revision"] = revision.Int
+			mResult["published"] = duration.Int > 0
+			dResult["meta"] = mResult
+		}
 		results[vid.String] = dResult
+		if maxReads.Int > 0 {
+			limited = append(limited, vid.String)
+		}
+		owners[vid.String] = int(owner.Int)
 		// Remove found entry from vidMap list.
 		delete(vidMap, vid.String)
 	}
+	rows.Close()
+	reader.close(ctx)
+
+	// Entries with read limit are only returned if the read could get
+	// counted. Otherwise, some other request was faster.
+	for _, vid := range limited {
+		remaining, ok := countPublishedRead(ctx, sid, vid)
+		if !ok {
+			delete(results, vid)
+			vidMap[vid] = true
+			continue
+		}
+		results[vid].(map[string]interface{})["remaining"] = remaining
+	}
+
+	// Record all published entries returned (only getpublished). This is
+	// not the case for get (see comment below).
+	if isPublish {
+		accesses := []publishAccess{}
+		for vid, r := range results {
+			if r.(map[string]interface{})["status"] == "OK" {
+				accesses = append(accesses, publishAccess{vid: vid, owner: owners[vid]})
+			}
+		}
+		go recordPublishAccess(accesses, sid, c.RealIP())
+	}
 
 	// All vids that remained in vidMap are missing ones.
 	// Add this to the results.
@@ -352,14 +1342,54 @@ func doGet(c echo.Context, clientRequest map[string]interface{}, isPublish bool)
 	rResult := make(map[string]interface{})
 	rResult["uid"] = uid
 	rResult["data"] = results
+	reader.addResult(rResult)
 	return generateResult(c, rResult)
 }
 
+// countPublishedRead atomically counts one read of some published entry
+// with read limit. It returns the number of remaining reads and true if
+// the read is allowed. If the limit is reached with this read, the entry
+// is deleted (unless it is on legal hold, then cleanupHeartBeat deletes
+// it later).
+func countPublishedRead(ctx context.Context, sid int, vid string) (int64, bool) {
+	var reads, maxReads, owner int64
+	sql := `UPDATE data SET READS = READS + 1
+			WHERE VID=$1 AND MAXREADS > 0 AND READS < MAXREADS
+			RETURNING READS, MAXREADS, PROVIDERID`
+	err := DB.QueryRow(ctx, sql, vid).Scan(&reads, &maxReads, &owner)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			LogInternalf("Failed to count read (getpublished) with SQL: %v Error: %v", sql, err)
+		}
+		return 0, false
+	}
+	go DoLog(LOG_TYPE_GET, int(owner),
+		fmt.Sprintf("%v (read %d of %d by sid %d)", vid, reads, maxReads, sid))
+
+	if reads >= maxReads {
+		sql = "DELETE FROM data WHERE VID=$1 AND READS >= MAXREADS AND " + SQL_NOT_ON_HOLD
+		ctag, err := DB.Exec(ctx, sql, vid)
+		if err != nil {
+			LogInternalf("Failed to delete payload (getpublished) with SQL: %v Error: %v", sql, err)
+		} else if ctag.RowsAffected() == 1 {
+			go DoLog(LOG_TYPE_DELETE, int(owner), vid+" (read limit reached)")
+		}
+	}
+	return maxReads - reads, true
+}
+
 // doSearch implements the "search" api operation
 func doSearch(c echo.Context, clientRequest map[string]interface{}) error {
 	sid := GetInt(clientRequest["sid"], 0)
 	uid := GetString(clientRequest["uid"], "")
-	words := GetStringArray(clientRequest["words"], []string{})
+	words, err := getSearchWords(clientRequest)
+
+	if clientRequest["query"] != nil {
+		return doSearchQuery(c, clientRequest)
+	}
+	if err != nil {
+		return generateError(c, DV_INVALID_ENCODING, err.Error())
+	}
 
 	if len(words) == 0 {
 		wds := GetString(clientRequest["words"], "")
@@ -376,18 +1406,39 @@ func doSearch(c echo.Context, clientRequest map[string]interface{}) error {
 			"Maximum "+strconv.Itoa(CNF_MAX_SEARCH_TERMS)+" search terms allowed")
 	}
 
+	for _, word := range words {
+		field, hash := SplitSearchWord(word)
+		if (field != "" && !ValidateSearchField(field)) || !ValidateSearchWord(hash) {
+			return generateError(c, DV_INVALID_ENCODING, "Invalid search word encoding")
+		}
+	}
+
+	params := []interface{}{sid}
+	sql := searchWordsSQL(words, &params)
+	return searchPage(c, clientRequest, uid, sql, params)
+}
+
+// searchWordsSQL returns the SQL query for the VIDs of the provider $1
+// having all of the given words (as prefix). Tagged words ("field:hash")
+// only match words of the same field, untagged words match any field.
+// The words are appended to params and referenced as $n, so they never
+// become part of the SQL.
+func searchWordsSQL(words []string, params *[]interface{}) string {
 	// Combine search query
 	sql := "SELECT t1.VID FROM search t1\n"
 	where := ""
 	for i, word := range words {
-		if !ValidateSearchWord(word) {
-			return generateError(c, DV_INVALID_ENCODING, "Invalid search word encoding")
-		}
 		if i > 0 {
 			sql += fmt.Sprintf("INNER JOIN search t%d ON (t1.VID = t%d.VID)\n",
 				i+1, i+1)
 		}
-		where += fmt.Sprintf("t%d.WORD LIKE '"+word+"%%'\n    AND ", i+1)
+		field, hash := SplitSearchWord(word)
+		if field != "" {
+			*params = append(*params, field)
+			where += fmt.Sprintf("t%d.FIELD = $%d AND ", i+1, len(*params))
+		}
+		*params = append(*params, EscapeLike(hash)+"%")
+		where += fmt.Sprintf("t%d.WORD LIKE $%d\n    AND ", i+1, len(*params))
 	}
 	where = where[:len(where)-4] // remove last "AND "
 	sql += " WHERE " + where     // concat with where conditions
@@ -395,12 +1446,92 @@ func doSearch(c echo.Context, clientRequest map[string]interface{}) error {
 	// Filter provider association by putting results in a sub-query
 	// which filters for provider id (sub-query seems more efficient here).
 	// This avoids later confusion while requesting all vids found.
-	sql = "SELECT VID FROM data WHERE VID IN(\n" + sql +
-		"\n) AND PROVIDERID=$1\n"
-	rows, err := DB.Query(sql, sid)
+	// Expired and deleted entries are not returned.
+	return "SELECT VID FROM data WHERE VID IN(\n" + sql +
+		"\n) AND PROVIDERID=$1 AND (EXPIRES IS NULL OR EXPIRES > NOW())" +
+		" AND DELETED IS NULL\n"
+}
+
+// doSearchQuery implements the "search" api operation for structured
+// queries (see searchquery.go).
+func doSearchQuery(c echo.Context, clientRequest map[string]interface{}) error {
+	sid := GetInt(clientRequest["sid"], 0)
+	uid := GetString(clientRequest["uid"], "")
+
+	complexity := getSearchComplexity()
+	query, err := parseSearchQuery(clientRequest["query"], complexity)
+	if err != nil {
+		code := DV_INVALID_ENCODING
+		var limitErr searchLimitError
+		if errors.As(err, &limitErr) {
+			code = DV_INVALID_PARAMSIZE // too complex or too deep
+		}
+		return generateError(c, code, "Invalid search query: "+err.Error())
+	}
+
+	// Expired and deleted entries are not returned.
+	params := []interface{}{sid}
+	sql := `SELECT VID FROM data WHERE PROVIDERID=$1 AND
+				(EXPIRES IS NULL OR EXPIRES > NOW()) AND DELETED IS NULL AND ` +
+		query.toSQL(&params)
+	return searchPage(c, clientRequest, uid, sql, params)
+}
+
+// searchPage runs the given search SQL (selecting VID from data) and
+// returns one page of VIDs, ordered by VID. The page is defined by the
+// limit and cursor fields of the request. The cursor is the last VID of
+// the previous page (base64 encoded).
+func searchPage(c echo.Context, clientRequest map[string]interface{}, uid string,
+	sql string, params []interface{}) error {
+	ctx := c.Request().Context()
+	limit := GetInt(clientRequest["limit"], CNF_MAX_SEARCH_RESULTS)
+	cursor := GetString(clientRequest["cursor"], "")
+
+	if limit < 1 || limit > CNF_MAX_SEARCH_RESULTS {
+		return generateError(c, DV_INVALID_PARAMSIZE,
+			"Invalid limit (1 to "+strconv.Itoa(CNF_MAX_SEARCH_RESULTS)+")")
+	}
+	var after []byte
+	if cursor != "" {
+		var err error
+		after, err = base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || !ValidateVID(string(after)) {
+			return generateError(c, DV_INVALID_ENCODING, "Invalid cursor")
+		}
+	}
+
+	// Count and page use the same reader. With follower reads, both see
+	// the same snapshot. Otherwise, they are separate statements and the
+	// total may differ from the pages if entries change meanwhile.
+	reader, err := newStaleReader(c, "search", clientRequest)
+	if err != nil {
+		LogInternalf("Failed to start follower read (search). Error: %v", err)
+		return generateDBError(c, err,
+			"Failed to query searchwords. Contact our support.")
+	}
+	defer reader.close(ctx)
+
+	// Count all matches, but not more than CNF_MAX_SEARCH_COUNT
+	total := 0
+	countSQL := "SELECT COUNT(*) FROM (" + sql + " LIMIT " +
+		strconv.Itoa(CNF_MAX_SEARCH_COUNT+1) + ") AS matches"
+	err = reader.db.QueryRow(ctx, countSQL, params...).Scan(&total)
+	if err != nil {
+		LogInternalf("Query error in search. SQL: %v Error: %v", countSQL, err)
+		return generateDBError(c, err,
+			"Failed to query searchwords. Contact our support.")
+	}
+
+	// Get one more than the limit to know if there is some next page
+	if after != nil {
+		params = append(params, after)
+		sql += " AND VID > $" + strconv.Itoa(len(params))
+	}
+	sql += " ORDER BY VID LIMIT " + strconv.Itoa(limit+1)
+	rows, err := reader.db.Query(ctx, sql, params...)
 	if err != nil {
 		LogInternalf("Query error in search. SQL: %v Error: %v", sql, err)
-		return generateError(c, DV_INTERNAL_ERROR,
+		return generateDBError(c, err,
 			"Failed to query searchwords. Contact our support.")
 	}
 	defer rows.Close()
@@ -419,6 +1550,18 @@ func doSearch(c echo.Context, clientRequest map[string]interface{}) error {
 	// Compile result
 	rResult := make(map[string]interface{})
 	rResult["uid"] = uid
+	if len(results) > limit {
+		results = results[:limit]
+		rResult["cursor"] = base64.RawURLEncoding.EncodeToString(
+			[]byte(results[limit-1]))
+	}
 	rResult["vids"] = results
+	rResult["total"] = total
+	rResult["totalexact"] = true
+	if total > CNF_MAX_SEARCH_COUNT {
+		rResult["total"] = CNF_MAX_SEARCH_COUNT
+		rResult["totalexact"] = false
+	}
+	reader.addResult(rResult)
 	return generateResult(c, rResult)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgtype"
+)
+
+func TestGetReaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		readers    interface{}
+		want       []int64
+		wantStatus pgtype.Status
+		wantErr    bool
+	}{
+		{"missing", nil, nil, pgtype.Null, false},
+		{"empty", []interface{}{}, nil, pgtype.Null, false},
+		{"sids", []interface{}{float64(2), "3"}, []int64{2, 3}, pgtype.Present, false},
+		{"invalid sid", []interface{}{"abc"}, nil, pgtype.Null, true},
+		{"zero sid", []interface{}{float64(0)}, nil, pgtype.Null, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getReaders(map[string]interface{}{"readers": tt.readers})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getReaders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("getReaders() status = %v, want %v", got.Status, tt.wantStatus)
+			}
+			var sids []int64
+			if got.Status == pgtype.Present {
+				got.AssignTo(&sids)
+			}
+			if !reflect.DeepEqual(sids, tt.want) {
+				t.Errorf("getReaders() = %v, want %v", sids, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSearchWords(t *testing.T) {
+	tests := []struct {
+		name    string
+		words   interface{}
+		want    []string
+		wantErr bool
+	}{
+		{"missing", nil, []string{}, false},
+		{"plain", []interface{}{"8f494a220b95", "a1b2"}, []string{"8f494a220b95", "a1b2"}, false},
+		{"tagged", []interface{}{map[string]interface{}{"field": "name", "hash": "8f494a220b95"}},
+			[]string{"name:8f494a220b95"}, false},
+		{"mixed", []interface{}{"a1b2", map[string]interface{}{"field": "zip", "hash": "c3d4"}},
+			[]string{"a1b2", "zip:c3d4"}, false},
+		{"invalid field", []interface{}{map[string]interface{}{"field": "a b", "hash": "a1b2"}},
+			nil, true},
+		{"invalid hash", []interface{}{map[string]interface{}{"field": "name", "hash": "a b"}},
+			nil, true},
+		{"colon in plain word", []interface{}{"name:a1b2"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getSearchWords(map[string]interface{}{"words": tt.words})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getSearchWords() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSearchWords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchItemExpiresArg(t *testing.T) {
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1)
+	tests := []struct {
+		name       string
+		item       batchItem
+		wantStatus pgtype.Status
+	}{
+		{"no expiry (eg revert)", batchItem{vid: "abc"}, pgtype.Null},
+		{"null expiry", batchItem{expires: pgtype.Timestamptz{Status: pgtype.Null}}, pgtype.Null},
+		{"expiry", batchItem{expires: pgtype.Timestamptz{Time: tomorrow, Status: pgtype.Present}},
+			pgtype.Present},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.item.expiresArg()
+			if got.Status != tt.wantStatus {
+				t.Errorf("expiresArg() status = %v, want %v", got.Status, tt.wantStatus)
+			}
+			// updatePayloadTx passes it as SQL argument
+			if _, err := got.EncodeBinary(nil, nil); err != nil {
+				t.Errorf("expiresArg() can not be encoded: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+/*
+This file contains the access log of published entries. Every
+successful getpublished of some VID is stored in the table
+"publishaccess" with the reading sid, IP and time. Only the publisher
+can query it using the "publishaccess" op. If the publisher has some
+WEBHOOK configured, it gets notified about every access.
+
+Regular get calls are not logged (see doGet).
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/labstack/echo/v4"
+)
+
+// publishAccess is one successful getpublished of some VID
+type publishAccess struct {
+	vid   string
+	owner int // sid of the publisher
+}
+
+// recordPublishAccess stores the given accesses of the reader sid with
+// the given IP and notifies the publishers. Run it async using go.
+func recordPublishAccess(accesses []publishAccess, sid int, ip string) {
+	if len(accesses) == 0 {
+		return
+	}
+	ctx := context.Background() // the request may be done already
+	sql := "INSERT INTO publishaccess (VID, PROVIDERID, READERID, IP, ACCESSDATE) VALUES "
+	params := []interface{}{sid, ip}
+	for i, a := range accesses {
+		if i > 0 {
+			sql += ", "
+		}
+		sql += "($" + strconv.Itoa(len(params)+1) + ", $" + strconv.Itoa(len(params)+2) +
+			", $1, $2, NOW())"
+		params = append(params, a.vid, a.owner)
+	}
+	_, err := DB.Exec(ctx, sql, params...)
+	if err != nil {
+		LogInternalf("Failed to store publish access with SQL: [%v] Error: %v", sql, err)
+	}
+
+	// Notify the publishers (only one query per publisher)
+	hooks := make(map[int]string)
+	for _, a := range accesses {
+		hook, ok := hooks[a.owner]
+		if !ok {
+			sql = "SELECT WEBHOOK FROM provider WHERE PROVIDERID=$1"
+			DB.QueryRow(ctx, sql, a.owner).Scan(&hook)
+			hooks[a.owner] = hook
+		}
+		if hook != "" {
+			notifyPublishAccess(hook, a.vid, sid, ip)
+		}
+	}
+}
+
+// notifyPublishAccess sends some access notification to the given
+// webhook URL using a JSON POST request.
+func notifyPublishAccess(hook string, vid string, sid int, ip string) {
+	body := make(map[string]interface{})
+	body["event"] = "publishaccess"
+	body["vid"] = vid
+	body["sid"] = sid
+	body["ip"] = ip
+	body["time"] = FormatDateTime(time.Now().UTC())
+	j, err := json.Marshal(body)
+	if err != nil {
+		panic("Error during JSON generation in notifyPublishAccess.")
+	}
+
+	client := http.Client{Timeout: CNF_WEBHOOK_TIMEOUT_SEC * time.Second}
+	resp, err := client.Post(hook, "application/json", bytes.NewReader(j))
+	if err != nil {
+		LogInternalf("Failed to call webhook %v (publishaccess): %v", hook, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		LogInternalf("Webhook %v returned status %v (publishaccess)", hook, resp.StatusCode)
+	}
+}
+
+// doPublishAccess implements the "publishaccess" api operation
+func doPublishAccess(c echo.Context, clientRequest map[string]interface{}) error {
+	ctx := c.Request().Context()
+	uid := GetString(clientRequest["uid"], "")
+	sid := GetInt(clientRequest["sid"], 0)
+	vid := GetString(clientRequest["vid"], "")
+
+	if !ValidateVID(vid) {
+		return generateError(c, DV_VID_NOT_FOUND, "Invalid VID")
+	}
+
+	// PROVIDERID is the publisher. The log is also available after the
+	// published entry was deleted.
+	sql := `SELECT READERID, IP, ACCESSDATE FROM publishaccess
+			WHERE VID=$1 AND PROVIDERID=$2 ORDER BY ACCESSDATE`
+	rows, err := DB.Query(ctx, sql, vid, sid)
+	if err != nil {
+		LogInternalf("Failed to query (publishaccess) with SQL: %v Error: %v", sql, err)
+		return generateDBError(c, err,
+			"Failed to query. Contact our support.")
+	}
+	defer rows.Close()
+
+	accesses := make([]interface{}, 0)
+	for rows.Next() {
+		var reader pgtype.Int2
+		var ip pgtype.Varchar
+		var accessed pgtype.Timestamptz
+		err = rows.Scan(&reader, &ip, &accessed)
+		if err != nil {
+			LogInternalf("Unexpected error while processing query result (publishaccess). Error: %v", err)
+			continue
+		}
+		aResult := make(map[string]interface{})
+		aResult["sid"] = reader.Int
+		aResult["ip"] = ip.String
+		aResult["time"] = FormatDateTime(accessed.Time.UTC())
+		accesses = append(accesses, aResult)
+	}
+
+	// Compile result
+	rResult := make(map[string]interface{})
+	rResult["uid"] = uid
+	rResult["vid"] = vid
+	rResult["accesses"] = accesses
+	return generateResult(c, rResult)
+}
+
+// cleanupPublishAccess deletes all access log entries older than
+// CNF_PUBLISH_ACCESS_DAYS. It is called by cleanupHeartBeat.
+func cleanupPublishAccess(ctx context.Context) {
+	sql := `DELETE FROM publishaccess WHERE ACCESSDATE < NOW() - $1 * INTERVAL '1 day'`
+	_, err := DB.Exec(ctx, sql, CNF_PUBLISH_ACCESS_DAYS)
+	if err != nil {
+		LogInternalf("Failed to delete old publish access entries (cleanupHeartBeat): %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+/*
+This file contains the data locality per service provider. Every
+provider may have some home region (see setregion op). With multiRegion
+enabled in config.json, the tables data, search and history are expected
+to be REGIONAL BY ROW tables of some multi-region CockroachDB database
+(see cockroach setup documentation). Then, the crdb_region of new data
+rows is set to the home region of their provider. Search words and
+history copy the region of their data row. Providers without home region
+use the default of CockroachDB (region of the gateway node).
+
+Moving some provider to another region updates the crdb_region of all
+its rows in chunks of CNF_REGION_CHUNK_ROWS. On other databases, or
+with multiRegion disabled, the home region is only stored.
+*/
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Default region of CockroachDB for REGIONAL BY ROW tables
+const SQL_DEFAULT_REGION = "default_to_database_primary_region(gateway_region())::crdb_internal_region"
+
+// isMultiRegion returns true if rows are placed by their crdb_region
+func isMultiRegion() bool {
+	return cfg.MultiRegion == 1 && DBIsCockroach
+}
+
+// regionColumn returns the additional column for INSERT statements into
+// the regional tables (data, search and history).
+func regionColumn() string {
+	if !isMultiRegion() {
+		return ""
+	}
+	return ", crdb_region"
+}
+
+// regionValue returns the additional value for INSERT statements into
+// the regional tables using the given SQL expression (see regionColumn).
+func regionValue(expr string) string {
+	if !isMultiRegion() {
+		return ""
+	}
+	return ", " + expr
+}
+
+// providerRegionSQL returns the SQL expression for the home region of
+// the provider given by the SQL parameter sidParam (eg "$3").
+func providerRegionSQL(sidParam string) string {
+	return `COALESCE((SELECT NULLIF(p.REGION, '') FROM provider p
+				WHERE p.PROVIDERID = ` + sidParam + `)::crdb_internal_region, ` +
+		SQL_DEFAULT_REGION + `)`
+}
+
+// dataRegionSQL returns the SQL expression for the region of the data
+// row given by the SQL parameter vidParam (eg "$1").
+func dataRegionSQL(vidParam string) string {
+	return `COALESCE((SELECT d.crdb_region FROM data d WHERE d.VID = ` + vidParam + `), ` +
+		SQL_DEFAULT_REGION + `)`
+}
+
+// opSetRegion does the setregion function
+func opSetRegion(request map[string]interface{}) {
+	ctx := context.Background()
+	sid := GetInt(request["sid"], 0)
+	region := GetString(request["region"], "")
+	if sid < 1 {
+		outError("Invalid sid parameter")
+		return
+	}
+	if region == "" {
+		outError("Missing region parameter")
+		return
+	}
+	if isMultiRegion() {
+		var found int
+		sql := "SELECT count(*) FROM [SHOW REGIONS FROM DATABASE] WHERE region=$1"
+		err := DB.QueryRow(ctx, sql, region).Scan(&found)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
+		}
+		if found == 0 {
+			outError("Invalid region parameter (not a region of the database)")
+			return
+		}
+	}
+
+	ctag, err := DB.Exec(ctx, "UPDATE provider SET REGION=$2 WHERE PROVIDERID=$1", sid, region)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to update provider region. Error: %v", err))
+	}
+	if ctag.RowsAffected() != 1 {
+		outError("Failed to update provider entry. Check your sid.")
+		return
+	}
+
+	dResult := make(map[string]interface{})
+	dResult["moved"] = moveProviderRows(ctx, sid, region)
+	DoLog(LOG_TYPE_REGION, sid, fmt.Sprintf("Moved to region %v (rows %v)", region, dResult["moved"]))
+	outResult(dResult)
+}
+
+// applyProviderRegions moves the rows of all providers having some home
+// region to this region (eg after restoring some backup).
+func applyProviderRegions(ctx context.Context) {
+	if !isMultiRegion() {
+		return
+	}
+	sql := "SELECT PROVIDERID, REGION FROM provider WHERE REGION != ''"
+	rows, err := DB.Query(ctx, sql)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
+	}
+	regions := make(map[int]string)
+	for rows.Next() {
+		var sid int
+		var region string
+		if err = rows.Scan(&sid, &region); err == nil {
+			regions[sid] = region
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		panic(fmt.Sprintf("Failed to query provider regions. Error: %v", rows.Err()))
+	}
+	for sid, region := range regions {
+		moveProviderRows(ctx, sid, region)
+	}
+}
+
+// moveProviderRows sets the crdb_region of all data, search and history
+// rows of the given provider. It returns the number of rows moved per
+// table. Nothing is moved without multiRegion.
+func moveProviderRows(ctx context.Context, sid int, region string) map[string]int64 {
+	moved := map[string]int64{"data": 0, "search": 0, "history": 0}
+	if !isMultiRegion() {
+		return moved
+	}
+	// search and history first, their rows are found using data
+	tables := []string{"search", "history", "data"}
+	for _, table := range tables {
+		where := "VID IN (SELECT VID FROM data WHERE PROVIDERID=$1)"
+		if table == "data" {
+			where = "PROVIDERID=$1"
+		}
+		sql := `UPDATE ` + table + ` SET crdb_region=$2::crdb_internal_region
+				WHERE ` + where + ` AND crdb_region != $2::crdb_internal_region LIMIT $3`
+		for {
+			var count int64
+			err := execTx(ctx, "setregion", func(tx pgx.Tx) error {
+				ctag, err := tx.Exec(ctx, sql, sid, region, CNF_REGION_CHUNK_ROWS)
+				count = ctag.RowsAffected()
+				return err
+			})
+			if err != nil {
+				panic(fmt.Sprintf("Failed to move %v rows with SQL: %v Error: %v", table, sql, err))
+			}
+			moved[table] += count
+			if count < CNF_REGION_CHUNK_ROWS {
+				break
+			}
+		}
+	}
+	return moved
+}
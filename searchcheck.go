@@ -0,0 +1,263 @@
+package main
+
+/*
+This file contains the consistency check of the search index (see
+checksearch op). It finds search words without some matching entry in
+the data table (orphaned), words stored twice for the same VID
+(duplicates) and VIDs having more words than expected (oversized).
+
+With "repair", orphaned and duplicate words are fixed in chunks of
+CNF_REPAIR_CHUNK_ROWS. Oversized word sets are only reported, because
+there is no way to know which words are the wrong ones.
+*/
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// opCheckSearch does the checksearch function
+func opCheckSearch(request map[string]interface{}) {
+	ctx := context.Background()
+	repair := GetBool(request["repair"], false)
+	maxWords := GetInt(request["maxwords"], CNF_MAX_WORDS_PER_VID)
+	if maxWords < 1 {
+		outError("Invalid maxwords parameter")
+		return
+	}
+
+	dResult := make(map[string]interface{})
+	dResult["orphaned"] = checkOrphanedWords(ctx)
+	dResult["duplicates"] = checkDuplicateWords(ctx)
+	dResult["oversized"] = checkOversizedWords(ctx, maxWords)
+
+	if repair {
+		orphaned := repairOrphanedWords(ctx)
+		duplicates := repairDuplicateWords(ctx)
+		repaired := make(map[string]interface{})
+		repaired["orphaned"] = orphaned
+		repaired["duplicates"] = duplicates
+		dResult["repaired"] = repaired
+		DoLog(LOG_TYPE_NOTICE, 0, fmt.Sprintf(
+			"Repaired search index (%v orphaned VIDs, %v duplicate words)",
+			orphaned, duplicates))
+	}
+	outResult(dResult)
+}
+
+// checkOrphanedWords returns the number of VIDs in the search table
+// without some entry in the data table and the first of them.
+func checkOrphanedWords(ctx context.Context) map[string]interface{} {
+	sql := `SELECT DISTINCT VID FROM search s
+			WHERE NOT EXISTS (SELECT 1 FROM data d WHERE d.VID = s.VID)`
+	rows, err := DB.Query(ctx, sql)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
+	}
+	defer rows.Close()
+
+	count := 0
+	vids := []string{}
+	for rows.Next() {
+		var vid pgtype.Varchar
+		err = rows.Scan(&vid)
+		if err != nil {
+			LogInternalf("Unexpected error while processing result (checksearch). Error: %v", err)
+			continue
+		}
+		count++
+		if len(vids) < CNF_CHECK_REPORT_ROWS {
+			vids = append(vids, vid.String)
+		}
+	}
+	if rows.Err() != nil {
+		panic(fmt.Sprintf("Failed to query orphaned words. Error: %v", rows.Err()))
+	}
+
+	result := make(map[string]interface{})
+	result["count"] = count
+	result["vids"] = vids
+	return result
+}
+
+// checkDuplicateWords returns the number of words stored more than once
+// for the same VID and the first of them.
+func checkDuplicateWords(ctx context.Context) map[string]interface{} {
+	sql := `SELECT VID, FIELD, WORD, COUNT(*) FROM search
+			GROUP BY VID, FIELD, WORD HAVING COUNT(*) > 1`
+	rows, err := DB.Query(ctx, sql)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
+	}
+	defer rows.Close()
+
+	count := 0
+	words := make([]interface{}, 0)
+	for rows.Next() {
+		var vid pgtype.Varchar
+		var field string
+		var word string
+		var n int
+		err = rows.Scan(&vid, &field, &word, &n)
+		if err != nil {
+			LogInternalf("Unexpected error while processing result (checksearch). Error: %v", err)
+			continue
+		}
+		count++
+		if len(words) < CNF_CHECK_REPORT_ROWS {
+			dLine := make(map[string]interface{})
+			dLine["vid"] = vid.String
+			dLine["field"] = field
+			dLine["word"] = word
+			dLine["count"] = n
+			words = append(words, dLine)
+		}
+	}
+	if rows.Err() != nil {
+		panic(fmt.Sprintf("Failed to query duplicate words. Error: %v", rows.Err()))
+	}
+
+	result := make(map[string]interface{})
+	result["count"] = count
+	result["words"] = words
+	return result
+}
+
+// checkOversizedWords returns the number of VIDs having more than
+// maxWords search words and the first of them.
+func checkOversizedWords(ctx context.Context, maxWords int) map[string]interface{} {
+	sql := "SELECT VID, COUNT(*) FROM search GROUP BY VID HAVING COUNT(*) > $1"
+	rows, err := DB.Query(ctx, sql, maxWords)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
+	}
+	defer rows.Close()
+
+	count := 0
+	vids := make([]interface{}, 0)
+	for rows.Next() {
+		var vid pgtype.Varchar
+		var n int
+		err = rows.Scan(&vid, &n)
+		if err != nil {
+			LogInternalf("Unexpected error while processing result (checksearch). Error: %v", err)
+			continue
+		}
+		count++
+		if len(vids) < CNF_CHECK_REPORT_ROWS {
+			dLine := make(map[string]interface{})
+			dLine["vid"] = vid.String
+			dLine["words"] = n
+			vids = append(vids, dLine)
+		}
+	}
+	if rows.Err() != nil {
+		panic(fmt.Sprintf("Failed to query oversized word sets. Error: %v", rows.Err()))
+	}
+
+	result := make(map[string]interface{})
+	result["count"] = count
+	result["vids"] = vids
+	return result
+}
+
+// repairOrphanedWords deletes all search words without some entry in
+// the data table. It returns the number of VIDs cleaned up.
+func repairOrphanedWords(ctx context.Context) int {
+	total := 0
+	for {
+		sql := `SELECT DISTINCT VID FROM search s
+				WHERE NOT EXISTS (SELECT 1 FROM data d WHERE d.VID = s.VID) LIMIT $1`
+		rows, err := DB.Query(ctx, sql, CNF_REPAIR_CHUNK_ROWS)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
+		}
+		vids := []string{}
+		for rows.Next() {
+			var vid pgtype.Varchar
+			if err = rows.Scan(&vid); err == nil {
+				vids = append(vids, vid.String)
+			}
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			panic(fmt.Sprintf("Failed to query orphaned words. Error: %v", rows.Err()))
+		}
+		if len(vids) == 0 {
+			return total
+		}
+
+		// Check data again, the VID might have been added meanwhile
+		sql = `DELETE FROM search WHERE VID=ANY($1::BYTES[]) AND
+				NOT EXISTS (SELECT 1 FROM data d WHERE d.VID = search.VID)`
+		_, err = DB.Exec(ctx, sql, VIDArray(vids))
+		if err != nil {
+			panic(fmt.Sprintf("Failed to delete orphaned words with SQL: %v Error: %v", sql, err))
+		}
+		total += len(vids)
+		if len(vids) < CNF_REPAIR_CHUNK_ROWS {
+			return total
+		}
+	}
+}
+
+// repairDuplicateWords removes all duplicate search words, so every
+// word is stored only once per VID. It returns the number of words
+// which were stored more than once.
+func repairDuplicateWords(ctx context.Context) int {
+	total := 0
+	for {
+		sql := `SELECT VID, FIELD, WORD FROM search
+				GROUP BY VID, FIELD, WORD HAVING COUNT(*) > 1 LIMIT $1`
+		rows, err := DB.Query(ctx, sql, CNF_REPAIR_CHUNK_ROWS)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to query with SQL: %v Error: %v", sql, err))
+		}
+		type searchRow struct {
+			vid   []byte
+			field string
+			word  string
+		}
+		dups := []searchRow{}
+		for rows.Next() {
+			var r searchRow
+			if err = rows.Scan(&r.vid, &r.field, &r.word); err == nil {
+				dups = append(dups, r)
+			}
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			panic(fmt.Sprintf("Failed to query duplicate words. Error: %v", rows.Err()))
+		}
+		if len(dups) == 0 {
+			return total
+		}
+
+		// The search table has no primary key. Thus, replace all copies
+		// by one new row (one transaction per chunk).
+		err = execTx(ctx, "checksearch", func(tx pgx.Tx) error {
+			for _, r := range dups {
+				_, err := tx.Exec(ctx, "DELETE FROM search WHERE VID=$1 AND FIELD=$2 AND WORD=$3",
+					r.vid, r.field, r.word)
+				if err == nil {
+					_, err = tx.Exec(ctx, "INSERT INTO search (VID, WORD, FIELD"+regionColumn()+
+						") VALUES($1, $2, $3"+regionValue(dataRegionSQL("$1"))+")", r.vid, r.word, r.field)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			panic(fmt.Sprintf("Failed to repair duplicate words. Error: %v", err))
+		}
+		total += len(dups)
+		if len(dups) < CNF_REPAIR_CHUNK_ROWS {
+			return total
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+/*
+This file contains the parser for structured search queries. A query
+is some JSON value built from the following nodes:
+
+	"hash"                 prefix match of some SearchHash
+	{"exact": "hash"}      exact match of some SearchHash
+	{"field": "name", "prefix": "hash"}
+	{"field": "name", "exact": "hash"}
+	                       like above, but only for words of this field
+	{"and": [node, ...]}   all nodes have to match
+	{"or": [node, ...]}    at least one node has to match
+	{"not": node}          the node must not match
+
+Example: surname AND (birthdate OR insurance number)
+
+	{"and": ["a1b2", {"or": [{"exact": "c3d4"}, "e5f6"]}]}
+
+Every node counts for the complexity of the query, which is limited
+(see searchComplexity in config.json). The resulting SQL condition
+only uses bound parameters.
+*/
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SQL expression returning the words of the search table like
+// SplitSearchWord expects them ("field:hash" or "hash")
+const SQL_SEARCH_WORD = `CASE WHEN FIELD = '' THEN WORD ELSE FIELD || ':' || WORD END`
+
+// searchNode is one node of some parsed search query
+type searchNode struct {
+	op       string // "prefix", "exact", "and", "or" or "not"
+	word     string // prefix and exact only
+	field    string // prefix and exact only (optional)
+	children []*searchNode
+}
+
+// searchLimitError is returned if some query exceeds the complexity
+// or nesting limits
+type searchLimitError string
+
+func (e searchLimitError) Error() string {
+	return string(e)
+}
+
+// getSearchComplexity returns the maximum complexity of search queries
+func getSearchComplexity() int {
+	if cfg.SearchComplexity < 1 {
+		return CNF_MAX_SEARCH_COMPLEXITY // default
+	}
+	return cfg.SearchComplexity
+}
+
+// parseSearchQuery parses the given JSON query (see above). It returns
+// an error if the query is invalid or exceeds the given complexity.
+func parseSearchQuery(query interface{}, complexity int) (*searchNode, error) {
+	count := 0
+	node, err := parseSearchNode(query, 1, &count, complexity)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isPositive() {
+		// A query without positive terms would match everything
+		return nil, errors.New("query needs some term that has to match")
+	}
+	return node, nil
+}
+
+// parseSearchNode parses one node and all of its children
+func parseSearchNode(query interface{}, depth int, count *int, complexity int) (*searchNode, error) {
+	*count++
+	if *count > complexity {
+		return nil, searchLimitError("query is too complex (maximum " +
+			strconv.Itoa(complexity) + " terms and operators)")
+	}
+	if depth > CNF_MAX_SEARCH_DEPTH {
+		return nil, searchLimitError("query is nested too deep (maximum " +
+			strconv.Itoa(CNF_MAX_SEARCH_DEPTH) + " levels)")
+	}
+
+	switch q := query.(type) {
+	case string:
+		if !ValidateSearchWord(q) {
+			return nil, errors.New("invalid search word encoding")
+		}
+		return &searchNode{op: "prefix", word: q}, nil
+	case map[string]interface{}:
+		if q["field"] != nil {
+			return parseSearchFieldNode(q)
+		}
+		if len(q) != 1 {
+			return nil, errors.New("every query object needs exactly one operator")
+		}
+		for op, value := range q {
+			switch op {
+			case "exact":
+				word, ok := value.(string)
+				if !ok || !ValidateSearchWord(word) {
+					return nil, errors.New("invalid search word encoding")
+				}
+				return &searchNode{op: op, word: word}, nil
+			case "not":
+				child, err := parseSearchNode(value, depth+1, count, complexity)
+				if err != nil {
+					return nil, err
+				}
+				return &searchNode{op: op, children: []*searchNode{child}}, nil
+			case "and", "or":
+				list, ok := value.([]interface{})
+				if !ok || len(list) == 0 {
+					return nil, errors.New(op + " needs some array of terms")
+				}
+				node := &searchNode{op: op}
+				for _, v := range list {
+					child, err := parseSearchNode(v, depth+1, count, complexity)
+					if err != nil {
+						return nil, err
+					}
+					node.children = append(node.children, child)
+				}
+				return node, nil
+			}
+			return nil, errors.New("unknown operator " + op)
+		}
+	}
+	return nil, errors.New("invalid query element")
+}
+
+// parseSearchFieldNode parses some node with field tag
+func parseSearchFieldNode(q map[string]interface{}) (*searchNode, error) {
+	field, ok := q["field"].(string)
+	if !ok || !ValidateSearchField(field) {
+		return nil, errors.New("invalid search field")
+	}
+	if len(q) != 2 {
+		return nil, errors.New("field needs exactly one of prefix or exact")
+	}
+	for _, op := range []string{"prefix", "exact"} {
+		if value, ok := q[op]; ok {
+			word, ok := value.(string)
+			if !ok || !ValidateSearchWord(word) {
+				return nil, errors.New("invalid search word encoding")
+			}
+			return &searchNode{op: op, word: word, field: field}, nil
+		}
+	}
+	return nil, errors.New("field needs exactly one of prefix or exact")
+}
+
+// isPositive returns true if the node can only match entries having
+// some of its search words (so it does not match everything).
+func (n *searchNode) isPositive() bool {
+	switch n.op {
+	case "prefix", "exact":
+		return true
+	case "and":
+		for _, child := range n.children {
+			if child.isPositive() {
+				return true
+			}
+		}
+		return false
+	case "or":
+		for _, child := range n.children {
+			if !child.isPositive() {
+				return false
+			}
+		}
+		return true
+	}
+	return false // not
+}
+
+// toSQL returns the SQL condition for the VID column of the data table.
+// All search words are appended to params and referenced as $n.
+func (n *searchNode) toSQL(params *[]interface{}) string {
+	field := ""
+	if n.field != "" {
+		*params = append(*params, n.field)
+		field = "FIELD = $" + strconv.Itoa(len(*params)) + " AND "
+	}
+	switch n.op {
+	case "prefix":
+		*params = append(*params, EscapeLike(n.word)+"%")
+		return "VID IN (SELECT VID FROM search WHERE " + field + "WORD LIKE $" +
+			strconv.Itoa(len(*params)) + ")"
+	case "exact":
+		*params = append(*params, n.word)
+		return "VID IN (SELECT VID FROM search WHERE " + field + "WORD = $" +
+			strconv.Itoa(len(*params)) + ")"
+	case "not":
+		return "NOT " + n.children[0].toSQL(params)
+	}
+	sql := "("
+	for i, child := range n.children {
+		if i > 0 {
+			sql += " " + strings.ToUpper(n.op) + " "
+		}
+		sql += child.toSQL(params)
+	}
+	return sql + ")"
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantSQL    string
+		wantParams []interface{}
+		wantErr    bool
+		wantLimit  bool
+	}{
+		{"single prefix", `"a1b2"`,
+			"VID IN (SELECT VID FROM search WHERE WORD LIKE $2)",
+			[]interface{}{1, "a1b2%"}, false, false},
+		{"and with or", `{"and": ["a1b2", {"or": [{"exact": "c3d4"}, "e5f6"]}]}`,
+			"(VID IN (SELECT VID FROM search WHERE WORD LIKE $2) AND " +
+				"(VID IN (SELECT VID FROM search WHERE WORD = $3) OR " +
+				"VID IN (SELECT VID FROM search WHERE WORD LIKE $4)))",
+			[]interface{}{1, "a1b2%", "c3d4", "e5f6%"}, false, false},
+		{"and not", `{"and": ["a1b2", {"not": {"exact": "c3d4"}}]}`,
+			"(VID IN (SELECT VID FROM search WHERE WORD LIKE $2) AND " +
+				"NOT VID IN (SELECT VID FROM search WHERE WORD = $3))",
+			[]interface{}{1, "a1b2%", "c3d4"}, false, false},
+		{"field prefix and exact", `{"and": [{"field": "surname", "prefix": "a1b2"}, {"field": "city", "exact": "c3d4"}]}`,
+			"(VID IN (SELECT VID FROM search WHERE FIELD = $2 AND WORD LIKE $3) AND " +
+				"VID IN (SELECT VID FROM search WHERE FIELD = $4 AND WORD = $5))",
+			[]interface{}{1, "surname", "a1b2%", "city", "c3d4"}, false, false},
+		{"invalid field", `{"field": "sur name", "prefix": "a1b2"}`, "", nil, true, false},
+		{"field without word", `{"field": "surname"}`, "", nil, true, false},
+		{"field with two words", `{"field": "surname", "prefix": "a1b2", "exact": "c3d4"}`, "", nil, true, false},
+		{"only not", `{"not": "a1b2"}`, "", nil, true, false},
+		{"or with not", `{"or": ["a1b2", {"not": "c3d4"}]}`, "", nil, true, false},
+		{"invalid word", `{"and": ["a1b2", "x' OR 1=1"]}`, "", nil, true, false},
+		{"unknown operator", `{"xor": ["a1b2", "c3d4"]}`, "", nil, true, false},
+		{"two operators", `{"and": ["a1b2"], "or": ["c3d4"]}`, "", nil, true, false},
+		{"empty and", `{"and": []}`, "", nil, true, false},
+		{"number", `12`, "", nil, true, false},
+		{"too complex", `{"or": ["a1", "a2", "a3", "a4", "a5"]}`, "", nil, true, true},
+		{"too deep", `{"and": [{"and": [{"and": [{"and": ["a1"]}]}]}]}`, "", nil, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query interface{}
+			if err := json.Unmarshal([]byte(tt.query), &query); err != nil {
+				t.Fatalf("invalid test query: %v", err)
+			}
+			node, err := parseSearchQuery(query, 5)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSearchQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var limitErr searchLimitError
+			if errors.As(err, &limitErr) != tt.wantLimit {
+				t.Errorf("parseSearchQuery() error = %v, want limit error %v", err, tt.wantLimit)
+			}
+			if err != nil {
+				return
+			}
+			params := []interface{}{1}
+			if got := node.toSQL(&params); got != tt.wantSQL {
+				t.Errorf("toSQL() = %v, want %v", got, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("toSQL() params = %v, want %v", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+// FuzzSearchNodeSQL verifies that search words never change the
+// structure of the SQL built from some query (even without validation).
+func FuzzSearchNodeSQL(f *testing.F) {
+	f.Add("surname", "a1b2", "c3d4")
+	f.Add("' OR 1=1 --", "' OR 1=1 --", "$1")
+	f.Add("$2", "%", "_\\")
+	f.Fuzz(func(t *testing.T, field string, w1 string, w2 string) {
+		if field == "" {
+			return // no field tag
+		}
+		build := func(field, w1, w2 string) *searchNode {
+			return &searchNode{op: "and", children: []*searchNode{
+				{op: "prefix", word: w1, field: field},
+				{op: "or", children: []*searchNode{
+					{op: "exact", word: w2},
+					{op: "not", children: []*searchNode{{op: "prefix", word: w2}}},
+				}},
+			}}
+		}
+		params := []interface{}{1}
+		got := build(field, w1, w2).toSQL(&params)
+		want := build("f", "x", "y").toSQL(&[]interface{}{1})
+		if got != want {
+			t.Fatalf("toSQL() = %v, want %v", got, want)
+		}
+		wantParams := []interface{}{1, field, EscapeLike(w1) + "%", w2, EscapeLike(w2) + "%"}
+		if !reflect.DeepEqual(params, wantParams) {
+			t.Errorf("toSQL() params = %v, want %v", params, wantParams)
+		}
+	})
+}
+
+// FuzzSearchWordsSQL verifies that search words never change the
+// structure of the SQL built for the words field.
+func FuzzSearchWordsSQL(f *testing.F) {
+	f.Add("surname", "a1b2", "c3d4")
+	f.Add("' OR 1=1 --", "' OR 1=1 --", "$1")
+	f.Add("$2", "%", "_\\")
+	f.Fuzz(func(t *testing.T, field string, w1 string, w2 string) {
+		if field == "" || strings.Contains(field, ":") || strings.Contains(w2, ":") {
+			return // first word must be tagged, second one untagged
+		}
+		params := []interface{}{1}
+		got := searchWordsSQL([]string{field + ":" + w1, w2}, &params)
+		want := searchWordsSQL([]string{"f:x", "y"}, &[]interface{}{1})
+		if got != want {
+			t.Fatalf("searchWordsSQL() = %v, want %v", got, want)
+		}
+		wantParams := []interface{}{1, field, EscapeLike(w1) + "%", EscapeLike(w2) + "%"}
+		if !reflect.DeepEqual(params, wantParams) {
+			t.Errorf("searchWordsSQL() params = %v, want %v", params, wantParams)
+		}
+	})
+}
+
+// FuzzParseSearchQuery verifies that no JSON query results in SQL
+// containing anything but operators and parameter references.
+func FuzzParseSearchQuery(f *testing.F) {
+	f.Add(`{"and": ["a1", {"or": [{"exact": "b2"}, {"not": "c3"}]}]}`)
+	f.Add(`{"exact": "' OR 1=1 --"}`)
+	f.Add(`["a1"]`)
+	f.Add(`{"field": "surname", "prefix": "a1"}`)
+	allowed := strings.NewReplacer(
+		"VID IN (SELECT VID FROM search WHERE FIELD = $", "",
+		" AND WORD LIKE $", "", " AND WORD = $", "",
+		"VID IN (SELECT VID FROM search WHERE WORD LIKE $", "",
+		"VID IN (SELECT VID FROM search WHERE WORD = $", "",
+		"NOT ", "", " AND ", "", " OR ", "", "(", "", ")", "")
+	f.Fuzz(func(t *testing.T, query string) {
+		var q interface{}
+		if json.Unmarshal([]byte(query), &q) != nil {
+			return
+		}
+		node, err := parseSearchQuery(q, CNF_MAX_SEARCH_COMPLEXITY)
+		if err != nil {
+			return
+		}
+		params := []interface{}{1}
+		sql := node.toSQL(&params)
+		if rest := strings.Trim(allowed.Replace(sql), "0123456789"); rest != "" {
+			t.Fatalf("unexpected SQL %q in %v", rest, sql)
+		}
+	})
+}
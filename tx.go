@@ -0,0 +1,114 @@
+package main
+
+/*
+This file contains the transaction handling. All writes using more than
+one statement run in execTx. If the database reports some serialization
+error (SQLSTATE 40001, eg under contention in CockroachDB), the work is
+retried with some backoff instead of failing with DV_INTERNAL_ERROR.
+
+On CockroachDB, the client-side retry protocol is used: the work runs
+after SAVEPOINT cockroach_restart and is retried after ROLLBACK TO
+SAVEPOINT cockroach_restart in the same transaction. This way, the
+transaction keeps its priority and wins against competing ones sooner.
+On other databases (or if the commit itself fails), the whole
+transaction is run again.
+
+The number of transactions, retries and failures per operation are
+available as metrics (see metrics.go).
+*/
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// execTx runs fn in some new transaction and commits it. Serialization
+// errors are retried (see above) up to CNF_MAX_TX_RETRIES runs of fn in
+// total. Thus, fn may run more than once and must not have any side
+// effects outside of the transaction. op is the operation name used
+// for metrics. The error returned by fn (or the commit) is returned as
+// is. If ctx gets cancelled, the transaction is rolled back.
+func execTx(ctx context.Context, op string, fn func(tx pgx.Tx) error) error {
+	tries := 0
+	var err error
+	for tries < CNF_MAX_TX_RETRIES {
+		err = runTx(ctx, fn, &tries)
+		if !isRetryError(err) || tries >= CNF_MAX_TX_RETRIES {
+			break // no backoff after the last try
+		}
+		txBackoff(tries) // run the whole transaction again
+	}
+	countTx(op, tries, err)
+	return err
+}
+
+// runTx runs fn in one new transaction. On CockroachDB, serialization
+// errors are retried within the transaction (see above). Every run of
+// fn increases tries.
+func runTx(ctx context.Context, fn func(tx pgx.Tx) error, tries *int) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no effect after commit
+
+	if !DBIsCockroach {
+		*tries++
+		if err = fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	if _, err = tx.Exec(ctx, "SAVEPOINT cockroach_restart"); err != nil {
+		return err
+	}
+	for {
+		*tries++
+		err = fn(tx)
+		if err == nil {
+			_, err = tx.Exec(ctx, "RELEASE SAVEPOINT cockroach_restart")
+			if err == nil {
+				return tx.Commit(ctx)
+			}
+		}
+		if !isRetryError(err) || *tries >= CNF_MAX_TX_RETRIES {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "ROLLBACK TO SAVEPOINT cockroach_restart"); err != nil {
+			return err
+		}
+		txBackoff(*tries)
+	}
+}
+
+// isRetryError returns true if the given error is some serialization
+// error and the transaction should get retried.
+func isRetryError(err error) bool {
+	return getPgErrorCode(err) == "40001"
+}
+
+// txBackoff waits before the next try of some transaction (see
+// txBackoffTime).
+func txBackoff(tries int) {
+	time.Sleep(txBackoffTime(tries))
+}
+
+// txBackoffTime returns the time to wait after the given number of
+// tries. It doubles with every try (up to CNF_TX_MAX_BACKOFF_MS) and is
+// randomized to avoid running into the same conflict again. There is
+// no wait if no try is left (see CNF_MAX_TX_RETRIES).
+func txBackoffTime(tries int) time.Duration {
+	if tries >= CNF_MAX_TX_RETRIES {
+		return 0
+	}
+	backoff := CNF_TX_BACKOFF_MS << uint(tries-1)
+	if backoff > CNF_TX_MAX_BACKOFF_MS || backoff <= 0 {
+		backoff = CNF_TX_MAX_BACKOFF_MS
+	}
+	wait := backoff/2 + rand.Intn(backoff/2+1)
+	return time.Duration(wait) * time.Millisecond
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTxBackoffTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		tries int
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"first retry", 1, 5 * time.Millisecond, 10 * time.Millisecond},
+		{"doubled", 3, 20 * time.Millisecond, 40 * time.Millisecond},
+		{"before last try", CNF_MAX_TX_RETRIES - 1, 40 * time.Millisecond, 80 * time.Millisecond},
+		{"after last try", CNF_MAX_TX_RETRIES, 0, 0},
+		{"beyond last try", 100, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				got := txBackoffTime(tt.tries)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("txBackoffTime(%d) = %v, want %v to %v", tt.tries, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
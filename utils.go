@@ -2,10 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os/user"
 	"reflect"
 	"regexp"
@@ -14,6 +16,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/jackc/pgx/v4"
+
 	//#include <unistd.h>
 	//#include <errno.h>
 	"C"
@@ -31,6 +35,43 @@ func GetCurrentDateTime() string {
 	return string(now.Format("2006-01-02 15:04:05"))
 }
 
+// FormatDateTime returns the given time in the following format:
+// "YYYY-MM-DD HH-MM-SS"
+func FormatDateTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// ParseExpiry returns the expiry time for the given expires date or
+// retention days. Only one of both may be given. The date is expected
+// as "YYYY-MM-DD" or "YYYY-MM-DD HH:MM:SS" (UTC) and must be in the
+// future. It returns a zero time if none of both is given.
+func ParseExpiry(expires string, retention int) (time.Time, error) {
+	if expires != "" && retention != 0 {
+		return time.Time{}, fmt.Errorf("Either expires or retention is allowed")
+	}
+	if retention != 0 {
+		if retention < 1 || retention > CNF_MAX_RETENTION_DAYS {
+			return time.Time{}, fmt.Errorf("Invalid retention range")
+		}
+		return time.Now().UTC().AddDate(0, 0, retention), nil
+	}
+	if expires == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", expires)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", expires)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid expires date")
+	}
+	if !t.After(time.Now()) ||
+		t.After(time.Now().AddDate(0, 0, CNF_MAX_RETENTION_DAYS)) {
+		return time.Time{}, fmt.Errorf("Invalid expires range")
+	}
+	return t, nil
+}
+
 // GetString casts an unknown interface to return as string.
 // Use this to cast json results without triggering panic in
 // case the type does not match (eg received float64 instead of string).
@@ -151,6 +192,27 @@ func GetStringArray(clientRequest interface{}, asDefault []string) []string {
 	return res
 }
 
+// GetMapArray casts an unknown interface to return as array of maps
+// (eg JSON array of objects). Entries which are not objects are
+// returned as empty maps to keep the positions.
+// Use this to cast json results without triggering panic.
+func GetMapArray(clientRequest interface{}, asDefault []map[string]interface{}) []map[string]interface{} {
+	list, ok := clientRequest.([]interface{})
+	if !ok {
+		return asDefault
+	}
+
+	var res = []map[string]interface{}{}
+	for _, value := range list {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
 // GenerateVID generates a new VID.
 // Actually, it is a 128 bit random number in hex encoding.
 func GenerateVID() string {
@@ -171,6 +233,25 @@ func ValidateVID(vid string) bool {
 	return true
 }
 
+// VIDArray converts the given VIDs into some SQL array argument. Use
+// it like DB.Query(ctx, "... WHERE VID=ANY($1::BYTES[])", VIDArray(vids)).
+func VIDArray(vids []string) [][]byte {
+	arr := make([][]byte, len(vids))
+	for i, vid := range vids {
+		arr[i] = []byte(vid)
+	}
+	return arr
+}
+
+// EscapeLike escapes the wildcards of LIKE patterns (%, _ and the
+// escape character \) in the given string. Use it for words which
+// are used as LIKE prefix like EscapeLike(word)+"%".
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 // MakeUnique ensures that every entry in a string
 // splice/array is unique
 func MakeUnique(names []string) []string {
@@ -186,44 +267,35 @@ func MakeUnique(names []string) []string {
 	return uniqueNames
 }
 
-// deleteOneVID deletes one entry from data with its vid
-// No security check here. Used for rollback mainly.
-func deleteOneVID(vid string) bool {
-	_, err := DB.Exec("DELETE FROM data WHERE VID=$1", vid)
-	if err != nil {
-		LogInternalf("Failed to delete payload (deleteOneVID) for VID %v. %v",
-			vid, err)
-		return false
+// checkSearchWordCount returns some *dvError if the given number of
+// search words exceeds the limit per VID (see CNF_MAX_WORDS_PER_VID).
+func checkSearchWordCount(count int) error {
+	if count > CNF_MAX_WORDS_PER_VID {
+		return &dvError{DV_INVALID_PARAMSIZE, fmt.Sprintf(
+			"Too many search words (maximum %d per VID)", CNF_MAX_WORDS_PER_VID), nil}
 	}
-	return true
+	return nil
 }
 
-// insertSearchWords inserts the given words into the
-// database and assigns them to the given vid.
-// No validation! No cleanup!
-func insertSearchWords(vid string, words []string) bool {
-	// add search words, needs at least one word
+// insertSearchWordsTx inserts the given words into the database
+// using the given transaction and assigns them to the given vid.
+// Only the number of words is validated (see checkSearchWordCount).
+// No cleanup!
+func insertSearchWordsTx(ctx context.Context, tx pgx.Tx, vid string, words []string) error {
 	words = MakeUnique(words) // ensure there are no duplicates
-	// make a fast batch insert of the words
-	tx, err := DB.Begin()
-	if err != nil {
-		return false
+	if err := checkSearchWordCount(len(words)); err != nil {
+		return err
 	}
+	sql := "INSERT INTO search (VID, WORD, FIELD" + regionColumn() + ") VALUES($1, $2, $3" +
+		regionValue(dataRegionSQL("$1")) + ")"
 	for _, word := range words {
-		_, err = tx.Exec("INSERT INTO search (VID, WORD) VALUES($1, $2)", vid, word)
+		field, hash := SplitSearchWord(word)
+		_, err := tx.Exec(ctx, sql, vid, hash, field)
 		if err != nil {
-			break
+			return err
 		}
 	}
-	if err == nil {
-		err = tx.Commit()
-	}
-	if err != nil {
-		LogInternalf("Failed to commit store words with SQL Error: %v", err)
-		tx.Rollback()
-		return false
-	}
-	return true
+	return nil
 }
 
 // ValidateSearchWord verifies if the given string is a valid search word
@@ -236,6 +308,43 @@ func ValidateSearchWord(vid string) bool {
 	return true
 }
 
+// ValidateSearchField verifies if the given string is a valid field
+// tag for search words (1-32 chars from A-Z, a-z, 0-9 and _)
+func ValidateSearchField(field string) bool {
+	match, _ := regexp.MatchString("^[A-Za-z0-9_]{1,32}$", field)
+	return match
+}
+
+// SplitSearchWord splits some search word into its field tag and
+// SearchHash. Tagged words are stored as "field:hash" (eg in the
+// history). Untagged words return an empty field.
+func SplitSearchWord(word string) (string, string) {
+	if i := strings.IndexByte(word, ':'); i >= 0 {
+		return word[:i], word[i+1:]
+	}
+	return "", word
+}
+
+// ValidateIdempotencyKey verifies if the given string is a valid
+// idempotency key (1-128 printable ASCII chars without spaces)
+func ValidateIdempotencyKey(key string) bool {
+	match, _ := regexp.MatchString("^[\\x21-\\x7E]{1,128}$", key)
+	return match
+}
+
+// ValidateWebhook verifies if the given string is a valid webhook URL
+// (http or https). An empty string is valid (no webhook).
+func ValidateWebhook(hook string) bool {
+	if hook == "" {
+		return true
+	}
+	u, err := url.Parse(hook)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
 // LogInternalf currently prints the message to the StdOut console.
 // It adds "ERROR:" in front of the message.
 func LogInternalf(message string, params ...interface{}) {
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 )
 
 func TestGetCurrentDateTime(t *testing.T) {
@@ -23,6 +29,47 @@ func TestGetCurrentDateTime(t *testing.T) {
 	}
 }
 
+func TestFormatDateTime(t *testing.T) {
+	t.Run("check format", func(t *testing.T) {
+		date := time.Date(2022, 5, 10, 13, 40, 47, 157329, time.UTC)
+		if got := FormatDateTime(date); got != "2022-05-10 13:40:47" {
+			t.Errorf("FormatDateTime() = %v, want %v", got, "2022-05-10 13:40:47")
+		}
+	})
+}
+
+func TestParseExpiry(t *testing.T) {
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+	tests := []struct {
+		name      string
+		expires   string
+		retention int
+		wantErr   bool
+		wantZero  bool
+	}{
+		{"nothing", "", 0, false, true},
+		{"date", tomorrow, 0, false, false},
+		{"date and time", tomorrow + " 13:40:47", 0, false, false},
+		{"retention", "", 30, false, false},
+		{"both", tomorrow, 30, true, true},
+		{"past date", "2020-01-01", 0, true, true},
+		{"invalid date", "01.01.2040", 0, true, true},
+		{"invalid retention", "", -1, true, true},
+		{"too long retention", "", CNF_MAX_RETENTION_DAYS + 1, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExpiry(tt.expires, tt.retention)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseExpiry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.IsZero() != tt.wantZero {
+				t.Errorf("ParseExpiry() = %v, want zero %v", got, tt.wantZero)
+			}
+		})
+	}
+}
+
 func TestGetString(t *testing.T) {
 	type args struct {
 		clientRequest interface{}
@@ -107,6 +154,23 @@ func TestGetStringArray(t *testing.T) {
 	}
 }
 
+func TestGetMapArray(t *testing.T) {
+	var manyType = []interface{}{map[string]interface{}{"data": "x"}, "invalid"}
+
+	t.Run("with valid interface array", func(t *testing.T) {
+		got := GetMapArray(manyType, nil)
+		want := []map[string]interface{}{{"data": "x"}, {}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetMapArray() = %v, want %v", got, want)
+		}
+	})
+	t.Run("with nil", func(t *testing.T) {
+		if got := GetMapArray(nil, nil); got != nil {
+			t.Errorf("GetMapArray() = %v, want %v", got, nil)
+		}
+	})
+}
+
 func TestGenerateVID(t *testing.T) {
 	t.Run("check length", func(t *testing.T) {
 		if got := GenerateVID(); len(got) != 32 {
@@ -149,3 +213,150 @@ func TestValidateSearchWord(t *testing.T) {
 		}
 	})
 }
+
+func TestValidateWebhook(t *testing.T) {
+	tests := []struct {
+		name string
+		hook string
+		want bool
+	}{
+		{"empty", "", true},
+		{"https", "https://example.com/dv/hook", true},
+		{"http with port", "http://10.0.0.1:8080/hook", true},
+		{"other scheme", "ftp://example.com/hook", false},
+		{"no host", "https:///hook", false},
+		{"no url", "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidateWebhook(tt.hook); got != tt.want {
+				t.Errorf("ValidateWebhook() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"valid one", "order-4711/2022", true},
+		{"empty", "", false},
+		{"with space", "order 4711", false},
+		{"non ascii", "bestellung-ä", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidateIdempotencyKey(tt.key); got != tt.want {
+				t.Errorf("ValidateIdempotencyKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// FuzzEscapeLike verifies that no input results in some unescaped
+// LIKE wildcard and that the escaping is reversible.
+func FuzzEscapeLike(f *testing.F) {
+	f.Add("a1b2")
+	f.Add("%_\\")
+	f.Add("' OR 1=1 --")
+	f.Fuzz(func(t *testing.T, s string) {
+		escaped := EscapeLike(s)
+		unescaped := []byte{}
+		for i := 0; i < len(escaped); i++ {
+			switch escaped[i] {
+			case '%', '_':
+				t.Fatalf("EscapeLike(%q) = %q has unescaped wildcard", s, escaped)
+			case '\\':
+				i++
+				if i == len(escaped) || !strings.ContainsRune(`\%_`, rune(escaped[i])) {
+					t.Fatalf("EscapeLike(%q) = %q has invalid escape", s, escaped)
+				}
+			}
+			unescaped = append(unescaped, escaped[i])
+		}
+		if string(unescaped) != s {
+			t.Errorf("EscapeLike(%q) = %q is not reversible", s, escaped)
+		}
+	})
+}
+
+func TestVIDArray(t *testing.T) {
+	vids := []string{"0123456789abcdef0123456789abcdef", "' OR 1=1 --"}
+	want := [][]byte{[]byte(vids[0]), []byte(vids[1])}
+	if got := VIDArray(vids); !reflect.DeepEqual(got, want) {
+		t.Errorf("VIDArray() = %v, want %v", got, want)
+	}
+}
+
+func TestSplitSearchWord(t *testing.T) {
+	tests := []struct {
+		word      string
+		wantField string
+		wantHash  string
+	}{
+		{"a1b2", "", "a1b2"},
+		{"surname:a1b2", "surname", "a1b2"},
+		{"a:b:c", "a", "b:c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			field, hash := SplitSearchWord(tt.word)
+			if field != tt.wantField || hash != tt.wantHash {
+				t.Errorf("SplitSearchWord() = %v, %v, want %v, %v",
+					field, hash, tt.wantField, tt.wantHash)
+			}
+		})
+	}
+}
+
+// wordsTx counts the search words inserted by insertSearchWordsTx
+type wordsTx struct {
+	pgx.Tx
+	inserted int
+}
+
+func (tx *wordsTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	tx.inserted++
+	return pgconn.CommandTag("INSERT 0 1"), nil
+}
+
+func TestInsertSearchWordsTx(t *testing.T) {
+	words := func(count int) []string {
+		list := make([]string, count)
+		for i := range list {
+			list[i] = fmt.Sprintf("%x", i+16)
+		}
+		return list
+	}
+	tests := []struct {
+		name     string
+		words    []string
+		inserted int
+		wantErr  bool
+	}{
+		{"limit", words(CNF_MAX_WORDS_PER_VID), CNF_MAX_WORDS_PER_VID, false},
+		{"duplicates", append(words(CNF_MAX_WORDS_PER_VID), "10"), CNF_MAX_WORDS_PER_VID, false},
+		{"too many", words(CNF_MAX_WORDS_PER_VID + 1), 0, true},
+		{"tagged", []string{"name:a1b2", "zip:a1b2"}, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &wordsTx{}
+			err := insertSearchWordsTx(context.Background(), tx, "vid", tt.words)
+			var dve *dvError
+			if tt.wantErr && !(errors.As(err, &dve) && dve.code == DV_INVALID_PARAMSIZE) {
+				t.Errorf("insertSearchWordsTx() error = %v, want DV_INVALID_PARAMSIZE", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("insertSearchWordsTx() error = %v", err)
+			}
+			if tx.inserted != tt.inserted {
+				t.Errorf("insertSearchWordsTx() inserted %v words, want %v", tx.inserted, tt.inserted)
+			}
+		})
+	}
+}